@@ -0,0 +1,211 @@
+package argocd
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buttahtoast/subst/pkg/config"
+)
+
+var (
+	// Characters which are not allowed in application names
+	nameRegex = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// AppOptions configures the generated applications
+type AppOptions struct {
+	// Repository and revision of the overlays
+	RepoURL  string
+	Revision string
+	// Project and namespace of the applications
+	Project   string
+	Namespace string
+	// Destination cluster, the destination namespace defaults to the application name
+	Server               string
+	DestinationNamespace string
+	// Name of the config management plugin (<name>-<version>)
+	Plugin string
+	// Prefix of the application names
+	Prefix string
+	// Secret names are derived like --convert-secret-name
+	ConvertSecretName bool
+}
+
+// Overlay is a kustomization an application is generated for
+type Overlay struct {
+	// Name of the application
+	Name string `json:"name"`
+	// Path of the kustomization within the repository
+	Path string `json:"path"`
+	// Destination namespace, which is the namespace of the secret with the decryption keys
+	Namespace string `json:"namespace"`
+	// Name of the secret with the decryption keys (derived from the application name like subst render)
+	Secret string `json:"secret"`
+}
+
+// Overlays returns the overlays of the directories (paths are relative to base). Application names are derived from
+// the directory names, if they are not unique from the paths. Errors if the names derived from the paths are not unique either
+func Overlays(base string, dirs []string, opts AppOptions) ([]Overlay, error) {
+	overlays := make([]Overlay, 0, len(dirs))
+	names := make(map[string]bool)
+	unique := true
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(base, dir)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		name := appName(opts.Prefix + path.Base(rel))
+		if names[name] {
+			unique = false
+		}
+		names[name] = true
+		overlays = append(overlays, Overlay{Name: name, Path: rel})
+	}
+
+	paths := make(map[string]string)
+	for i := range overlays {
+		o := &overlays[i]
+		if !unique {
+			o.Name = appName(opts.Prefix + o.Path)
+			// eg. a-b/c and a/b/c
+			if other, ok := paths[o.Name]; ok {
+				return nil, fmt.Errorf("application name %s of %s and %s is not unique", o.Name, other, o.Path)
+			}
+			paths[o.Name] = o.Path
+		}
+		if o.Name == "" {
+			return nil, fmt.Errorf("can't derive application name for %s", o.Path)
+		}
+		o.Namespace = opts.DestinationNamespace
+		if o.Namespace == "" {
+			o.Namespace = o.Name
+		}
+		// ArgoCD passes the application name with the project (<project-name>_<application-name>)
+		o.Secret = config.SecretName(opts.Project+"_"+o.Name, opts.ConvertSecretName)
+	}
+	return overlays, nil
+}
+
+// returns the name as valid application name (lowercase alphanumeric characters and dashes)
+func appName(name string) string {
+	return strings.Trim(nameRegex.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+type metadata struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type info struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type plugin struct {
+	Name string `json:"name,omitempty"`
+}
+
+type source struct {
+	RepoURL        string  `json:"repoURL"`
+	TargetRevision string  `json:"targetRevision,omitempty"`
+	Path           string  `json:"path"`
+	Plugin         *plugin `json:"plugin"`
+}
+
+type destination struct {
+	Server    string `json:"server"`
+	Namespace string `json:"namespace"`
+}
+
+type applicationSpec struct {
+	Project     string      `json:"project"`
+	Source      source      `json:"source"`
+	Destination destination `json:"destination"`
+	Info        []info      `json:"info,omitempty"`
+}
+
+// Application is an ArgoCD application
+type Application struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   metadata        `json:"metadata"`
+	Spec       applicationSpec `json:"spec"`
+}
+
+// ApplicationSet is an ArgoCD application set with a list generator
+type ApplicationSet struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Metadata   metadata           `json:"metadata"`
+	Spec       applicationSetSpec `json:"spec"`
+}
+
+type applicationSetSpec struct {
+	GoTemplate bool        `json:"goTemplate"`
+	Generators []generator `json:"generators"`
+	Template   template    `json:"template"`
+}
+
+type generator struct {
+	List listGenerator `json:"list"`
+}
+
+type listGenerator struct {
+	Elements []Overlay `json:"elements"`
+}
+
+type template struct {
+	Metadata metadata        `json:"metadata"`
+	Spec     applicationSpec `json:"spec"`
+}
+
+// Applications returns an application per overlay
+func Applications(overlays []Overlay, opts AppOptions) []Application {
+	apps := make([]Application, 0, len(overlays))
+	for _, o := range overlays {
+		apps = append(apps, Application{
+			APIVersion: "argoproj.io/v1alpha1",
+			Kind:       "Application",
+			Metadata:   metadata{Name: o.Name, Namespace: opts.Namespace},
+			Spec:       spec(opts, o.Path, o.Namespace, o.Secret),
+		})
+	}
+	return apps
+}
+
+// NewApplicationSet returns the application set generating an application per overlay
+func NewApplicationSet(name string, overlays []Overlay, opts AppOptions) ApplicationSet {
+	return ApplicationSet{
+		APIVersion: "argoproj.io/v1alpha1",
+		Kind:       "ApplicationSet",
+		Metadata:   metadata{Name: name, Namespace: opts.Namespace},
+		Spec: applicationSetSpec{
+			GoTemplate: true,
+			Generators: []generator{{List: listGenerator{Elements: overlays}}},
+			Template: template{
+				Metadata: metadata{Name: "{{ .name }}"},
+				Spec:     spec(opts, "{{ .path }}", "{{ .namespace }}", "{{ .secret }}"),
+			},
+		},
+	}
+}
+
+func spec(opts AppOptions, path string, namespace string, secret string) applicationSpec {
+	return applicationSpec{
+		Project: opts.Project,
+		Source: source{
+			RepoURL:        opts.RepoURL,
+			TargetRevision: opts.Revision,
+			Path:           path,
+			Plugin:         &plugin{Name: opts.Plugin},
+		},
+		Destination: destination{Server: opts.Server, Namespace: namespace},
+		Info: []info{
+			{Name: "subst secret", Value: namespace + "/" + secret},
+		},
+	}
+}
@@ -0,0 +1,35 @@
+package argocd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOverlays(t *testing.T) {
+	tests := []struct {
+		name  string
+		dirs  []string
+		names []string
+		err   bool
+	}{
+		{name: "directory names", dirs: []string{"/repo/clusters/a", "/repo/clusters/b"}, names: []string{"a", "b"}},
+		{name: "path names", dirs: []string{"/repo/dev/app", "/repo/prod/app"}, names: []string{"dev-app", "prod-app"}},
+		{name: "path names not unique", dirs: []string{"/repo/a-b/c", "/repo/a/b/c"}, err: true},
+		{name: "no name", dirs: []string{"/repo/_"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overlays, err := Overlays("/repo", tt.dirs, AppOptions{})
+			if (err != nil) != tt.err {
+				t.Fatalf("Overlays() error = %v, error expected %t", err, tt.err)
+			}
+			var names []string
+			for _, o := range overlays {
+				names = append(names, o.Name)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("Overlays() names = %v, %v expected", names, tt.names)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package argocd
+
+import "strings"
+
+const (
+	// Directory the plugin configuration is read from by the cmp server
+	pluginConfigPath = "/home/argocd/cmp-server/config/plugin.yaml"
+	// ConfigMap created by the argo-cd chart for configs.cmp.plugins (keys are <plugin>.yaml)
+	pluginConfigMap = "argocd-cmp-cm"
+	// Cache directory of the sidecar (the root filesystem is read-only), used unless --cache-dir is passed
+	pluginCacheDir = "/home/argocd/.cache/subst"
+	// User and group of the argocd images
+	pluginUser = 999
+)
+
+// PluginOptions configures the generated plugin configuration
+type PluginOptions struct {
+	// Name and version of the plugin, applications reference <name>-<version>
+	Name    string
+	Version string
+	// Path of the subst binary within the sidecar
+	Command string
+	// Flags passed to render and parameters
+	Args []string
+	// Image of the sidecar
+	Image string
+}
+
+type command struct {
+	Command []string `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type discover struct {
+	FileName string `json:"fileName"`
+}
+
+type parameters struct {
+	Dynamic command `json:"dynamic"`
+}
+
+// PluginSpec is the specification of a config management plugin
+type PluginSpec struct {
+	Version    string     `json:"version"`
+	Discover   discover   `json:"discover"`
+	Generate   command    `json:"generate"`
+	Parameters parameters `json:"parameters"`
+}
+
+// Plugin is an ArgoCD config management plugin configuration
+type Plugin struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   metadata   `json:"metadata"`
+	Spec       PluginSpec `json:"spec"`
+}
+
+// NewPlugin returns the plugin configuration, render and parameters use the same flags
+func NewPlugin(opts PluginOptions) Plugin {
+	return Plugin{
+		APIVersion: "argoproj.io/v1alpha1",
+		Kind:       "ConfigManagementPlugin",
+		Metadata:   metadata{Name: opts.Name},
+		Spec:       pluginSpec(opts),
+	}
+}
+
+func pluginSpec(opts PluginOptions) PluginSpec {
+	return PluginSpec{
+		Version:  opts.Version,
+		Discover: discover{FileName: "./kustomization.yaml"},
+		Generate: command{
+			Command: []string{opts.Command},
+			Args:    append([]string{"render", "."}, opts.Args...),
+		},
+		Parameters: parameters{
+			Dynamic: command{
+				Command: []string{opts.Command},
+				Args:    append([]string{"parameters", "."}, opts.Args...),
+			},
+		},
+	}
+}
+
+// NewValues returns the values of the argo-cd chart for the sidecar. The plugin configuration
+// is created by the chart (configs.cmp) and mounted into the sidecar
+func NewValues(opts PluginOptions) map[string]interface{} {
+	securityContext := map[string]interface{}{
+		"allowPrivilegeEscalation": false,
+		"capabilities":             map[string]interface{}{"drop": []string{"all"}},
+		"readOnlyRootFilesystem":   true,
+		"runAsUser":                pluginUser,
+		"runAsGroup":               pluginUser,
+	}
+
+	cacheDir, ok := flagValue(opts.Args, "--cache-dir")
+	if !ok {
+		cacheDir = pluginCacheDir
+		opts.Args = append(opts.Args, "--cache-dir", cacheDir)
+	}
+
+	volumes := []interface{}{
+		map[string]interface{}{"name": "subst-tmp", "emptyDir": map[string]interface{}{}},
+		map[string]interface{}{"name": "subst-cache", "emptyDir": map[string]interface{}{}},
+		map[string]interface{}{"name": "subst-plugin", "configMap": map[string]interface{}{"name": pluginConfigMap}},
+	}
+	mounts := []interface{}{
+		map[string]interface{}{"name": "var-files", "mountPath": "/var/run/argocd"},
+		map[string]interface{}{"name": "plugins", "mountPath": "/home/argocd/cmp-server/plugins"},
+		// Do not share the tmp volume with the repo-server container (mitigates path traversal attacks)
+		map[string]interface{}{"name": "subst-tmp", "mountPath": "/tmp"},
+		map[string]interface{}{"name": "subst-cache", "mountPath": cacheDir},
+		map[string]interface{}{"name": "subst-plugin", "mountPath": pluginConfigPath, "subPath": opts.Name + ".yaml"},
+	}
+	return map[string]interface{}{
+		"configs": map[string]interface{}{
+			"cmp": map[string]interface{}{
+				"create":  true,
+				"plugins": map[string]interface{}{opts.Name: pluginSpec(opts)},
+			},
+		},
+		"repoServer": map[string]interface{}{
+			"clusterAdminAccess":       map[string]interface{}{"enabled": true},
+			"containerSecurityContext": securityContext,
+			"volumes":                  volumes,
+			"extraContainers": []interface{}{
+				map[string]interface{}{
+					"name":            "cmp-" + opts.Name,
+					"command":         []string{"/var/run/argocd/argocd-cmp-server"},
+					"image":           opts.Image,
+					"imagePullPolicy": "IfNotPresent",
+					"securityContext": securityContext,
+					"resources": map[string]interface{}{
+						"limits":   map[string]interface{}{"cpu": "500m", "memory": "512Mi"},
+						"requests": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+					},
+					"volumeMounts": mounts,
+				},
+			},
+		},
+	}
+}
+
+// returns the value of the flag within the args (--flag value or --flag=value)
+func flagValue(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return "", false
+}
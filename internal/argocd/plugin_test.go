@@ -0,0 +1,39 @@
+package argocd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewValuesCacheDir(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		mount string
+		want  []string
+	}{
+		{name: "default", args: []string{"--helm-command", "/helm"}, mount: pluginCacheDir, want: []string{"render", ".", "--helm-command", "/helm", "--cache-dir", pluginCacheDir}},
+		{name: "flag", args: []string{"--cache-dir", "/cache"}, mount: "/cache", want: []string{"render", ".", "--cache-dir", "/cache"}},
+		{name: "flag with value", args: []string{"--cache-dir=/cache"}, mount: "/cache", want: []string{"render", ".", "--cache-dir=/cache"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := NewValues(PluginOptions{Name: "subst", Command: "/subst", Args: tt.args})
+
+			spec := values["configs"].(map[string]interface{})["cmp"].(map[string]interface{})["plugins"].(map[string]interface{})["subst"].(PluginSpec)
+			if !reflect.DeepEqual(spec.Generate.Args, tt.want) {
+				t.Errorf("args = %v, %v expected", spec.Generate.Args, tt.want)
+			}
+
+			container := values["repoServer"].(map[string]interface{})["extraContainers"].([]interface{})[0].(map[string]interface{})
+			var mounted bool
+			for _, m := range container["volumeMounts"].([]interface{}) {
+				m := m.(map[string]interface{})
+				mounted = mounted || (m["name"] == "subst-cache" && m["mountPath"] == tt.mount)
+			}
+			if !mounted {
+				t.Errorf("cache volume not mounted at %s", tt.mount)
+			}
+		})
+	}
+}
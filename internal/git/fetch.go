@@ -0,0 +1,168 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	commitRegex = regexp.MustCompile("^[0-9a-f]{40}$")
+	// scp-like repositories ([user@]host:path), <transport>::<address> selects a remote helper
+	scpRegex = regexp.MustCompile(`^([A-Za-z0-9._~-]+@)?[A-Za-z0-9.-]+:[^/:]`)
+)
+
+// Environment restricting git to network protocols (no local repositories, no ext commands), without commands
+// configured by the repository (fsmonitor) and without writing the index of the work tree
+var restrictedEnv = []string{
+	"GIT_PROTOCOL_FROM_USER=0",
+	"GIT_OPTIONAL_LOCKS=0",
+	"GIT_CONFIG_COUNT=2",
+	"GIT_CONFIG_KEY_0=protocol.file.allow",
+	"GIT_CONFIG_VALUE_0=never",
+	"GIT_CONFIG_KEY_1=core.fsmonitor",
+	"GIT_CONFIG_VALUE_1=false",
+}
+
+// ValidateRemote verifies the repository (https, ssh or scp-like) and the ref of repository controlled references.
+// Neither may start with a dash, which git would interpret as an option
+func ValidateRemote(repository string, ref string) error {
+	if strings.HasPrefix(repository, "-") || strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid repository %s@%s: must not start with a dash", repository, ref)
+	}
+	switch {
+	case strings.HasPrefix(repository, "https://"), strings.HasPrefix(repository, "ssh://"):
+	case !strings.Contains(repository, "://") && scpRegex.MatchString(repository):
+	default:
+		return fmt.Errorf("invalid repository %s: only https, ssh and scp-like repositories are supported", repository)
+	}
+	return nil
+}
+
+// NormalizeRef returns the ref which is fetched (HEAD if empty)
+func NormalizeRef(ref string) string {
+	if ref == "" {
+		return "HEAD"
+	}
+	return ref
+}
+
+// Fetch checks out the ref of the repository (shallow) into a directory named by the commit within the
+// cache entry and returns that directory, this requires the git binary. Checkouts are prepared in a temporary
+// directory and renamed into place, once created they are never modified (concurrent fetches of the same
+// entry don't interfere). Existing checkouts are reused for commits (immutable) and in offline mode.
+// Only network protocols are allowed, see ValidateRemote for repository controlled references
+func Fetch(repository string, ref string, entry string, offline bool) (string, error) {
+	ref = NormalizeRef(ref)
+	if strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid ref %s: must not start with a dash", ref)
+	}
+
+	// The commit last fetched for the ref
+	cached := ref
+	if !commitRegex.MatchString(ref) {
+		head, err := os.ReadFile(filepath.Join(entry, "HEAD"))
+		if err == nil {
+			cached = strings.TrimSpace(string(head))
+		}
+	}
+	if commitRegex.MatchString(cached) && (offline || cached == ref) {
+		dir := filepath.Join(entry, cached)
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			logrus.Debugf("using cached %s@%s", repository, ref)
+			return dir, nil
+		}
+	}
+	if offline {
+		return "", fmt.Errorf("offline mode and no cached copy of %s@%s available", repository, ref)
+	}
+
+	if err := os.MkdirAll(entry, 0o700); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(entry, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := checkout(repository, ref, tmp, restrictedEnv); err != nil {
+		return "", err
+	}
+	out, err := run(tmp, restrictedEnv, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	commit := strings.TrimSpace(out)
+
+	dir := filepath.Join(entry, commit)
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another fetch checked out the same commit
+		if _, serr := os.Stat(filepath.Join(dir, ".git")); serr != nil {
+			return "", err
+		}
+	}
+	if err := utils.WriteFileAtomic(filepath.Join(entry, "HEAD"), []byte(commit+"\n")); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// FetchLocal checks out the ref of the repository into dir without protocol restrictions, which allows
+// local repositories. Only use it for references given by the user (not read from the repository)
+func FetchLocal(repository string, ref string, dir string) error {
+	ref = NormalizeRef(ref)
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid ref %s: must not start with a dash", ref)
+	}
+	return checkout(repository, ref, dir, nil)
+}
+
+// ReadFile reads the file within the checkout, symlinks are rejected (they could point outside of the checkout)
+func ReadFile(dir string, name string) ([]byte, error) {
+	file := dir
+	for _, part := range strings.Split(path.Clean("/" + name)[1:], "/") {
+		file = filepath.Join(file, part)
+		info, err := os.Lstat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s: symlinks are not supported", name)
+		}
+	}
+	return os.ReadFile(file)
+}
+
+// fetches the ref of the repository into the empty directory and checks it out
+func checkout(repository string, ref string, dir string, env []string) error {
+	if _, err := run(dir, env, "init", "--quiet"); err != nil {
+		return err
+	}
+	if _, err := run(dir, env, "fetch", "--quiet", "--depth", "1", "--", repository, ref); err != nil {
+		return err
+	}
+	_, err := run(dir, env, "checkout", "--quiet", "--force", "FETCH_HEAD")
+	return err
+}
+
+// runs git within the given directory, with the additional environment. Returns the output
+func run(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,131 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestValidateRemote(t *testing.T) {
+	tests := []struct {
+		repository string
+		ref        string
+		valid      bool
+	}{
+		{"https://github.com/example/repo.git", "v1.0.0", true},
+		{"ssh://git@github.com/example/repo.git", "", true},
+		{"git@github.com:example/repo.git", "main", true},
+		{"github.com:example/repo.git", "main", true},
+		{"http://example.com/repo.git", "", false},
+		{"file:///srv/git/repo.git", "", false},
+		{"/srv/git/repo.git", "", false},
+		{"../repo", "", false},
+		{"--upload-pack=touch /tmp/pwned", "", false},
+		{"https://github.com/example/repo.git", "--upload-pack=sh", false},
+		{"ext::sh -c touch% /tmp/pwned", "", false},
+	}
+	for _, tt := range tests {
+		err := ValidateRemote(tt.repository, tt.ref)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateRemote(%q, %q) = %v, valid %t expected", tt.repository, tt.ref, err, tt.valid)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeFile(t, dir, "a/b.yaml", "key: value\n")
+	writeFile(t, outside, "secret.yaml", "key: secret\n")
+	for _, link := range []struct{ target, name string }{
+		{filepath.Join(outside, "secret.yaml"), "link.yaml"},
+		{outside, "linked"},
+	} {
+		if err := os.Symlink(link.target, filepath.Join(dir, link.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		want  string
+		valid bool
+	}{
+		{name: "a/b.yaml", want: "key: value\n", valid: true},
+		{name: "/a/../a/b.yaml", want: "key: value\n", valid: true},
+		{name: "../a/b.yaml", want: "key: value\n", valid: true},
+		{name: "link.yaml"},
+		{name: "linked/secret.yaml"},
+		{name: "missing.yaml"},
+	}
+	for _, tt := range tests {
+		got, err := ReadFile(dir, tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("ReadFile(%q) = %v, valid %t expected", tt.name, err, tt.valid)
+		}
+		if tt.valid && string(got) != tt.want {
+			t.Errorf("ReadFile(%q) = %q, %q expected", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	repository := fixture(t)
+	// The fixture is a local repository
+	env := restrictedEnv
+	restrictedEnv = nil
+	t.Cleanup(func() { restrictedEnv = env })
+
+	entry := filepath.Join(t.TempDir(), "entry")
+	head := gitCmd(t, repository, "rev-parse", "HEAD")
+
+	// Concurrent fetches of the same entry end up in the same checkout
+	dirs := make([]string, 4)
+	errs := make([]error, len(dirs))
+	var wg sync.WaitGroup
+	for i := range dirs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dirs[i], errs[i] = Fetch(repository, "main", entry, false)
+		}(i)
+	}
+	wg.Wait()
+	for i := range dirs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if dirs[i] != filepath.Join(entry, head) {
+			t.Errorf("Fetch() = %s, %s expected", dirs[i], filepath.Join(entry, head))
+		}
+	}
+	if data, err := ReadFile(dirs[0], "c.txt"); err != nil || string(data) != "c\n" {
+		t.Errorf("ReadFile() = %q, %v", data, err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(entry, ".tmp-*")); len(tmp) > 0 {
+		t.Errorf("temporary checkouts left: %v", tmp)
+	}
+
+	// New commits are checked out next to the existing checkout, which is not modified
+	writeFile(t, repository, "c.txt", "changed\n")
+	gitCmd(t, repository, "commit", "--quiet", "--all", "--message", "fourth")
+	dir, err := Fetch(repository, "main", entry, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(entry, gitCmd(t, repository, "rev-parse", "HEAD")); dir != want {
+		t.Errorf("Fetch() = %s, %s expected", dir, want)
+	}
+	if data, err := ReadFile(dirs[0], "c.txt"); err != nil || string(data) != "c\n" {
+		t.Errorf("previous checkout modified: %q, %v", data, err)
+	}
+
+	// Offline mode uses the last fetched commit
+	if offline, err := Fetch(repository, "main", entry, true); err != nil || offline != dir {
+		t.Errorf("Fetch() offline = %s, %v, %s expected", offline, err, dir)
+	}
+	if _, err := Fetch(repository, "other", filepath.Join(t.TempDir(), "entry"), true); err == nil {
+		t.Error("Fetch() offline without cached copy succeeded")
+	}
+}
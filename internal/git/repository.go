@@ -0,0 +1,126 @@
+// Package git reads metadata of local repositories and fetches remote repositories, both with the git binary
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotRepository is returned if no repository was found
+var ErrNotRepository = errors.New("not a git repository")
+
+type Repository struct {
+	// Root of the checkout
+	workTree string
+}
+
+type Commit struct {
+	Hash    string
+	Tree    string
+	Parents []string
+	Time    time.Time
+}
+
+// Open searches the repository containing path (walking up the directories), reading it requires the git binary
+func Open(path string) (*Repository, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		// Worktrees and submodules have a .git file
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			if _, err := exec.LookPath("git"); err != nil {
+				return nil, fmt.Errorf("reading the repository %s requires the git binary: %w", dir, err)
+			}
+			return &Repository{workTree: dir}, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, ErrNotRepository
+		}
+		dir = parent
+	}
+}
+
+// WorkTree returns the root directory of the checkout
+func (r *Repository) WorkTree() string {
+	return r.workTree
+}
+
+// Head returns the current branch (empty if detached) and commit
+func (r *Repository) Head() (branch string, hash string, err error) {
+	out, err := run(r.workTree, restrictedEnv, "rev-parse", "HEAD", "--symbolic-full-name", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("unexpected output of git rev-parse: %q", out)
+	}
+	// Detached HEAD has no symbolic name
+	if ref := lines[1]; strings.HasPrefix(ref, "refs/heads/") {
+		branch = strings.TrimPrefix(ref, "refs/heads/")
+	}
+	return branch, lines[0], nil
+}
+
+// Commit reads the commit with the given hash
+func (r *Repository) Commit(hash string) (*Commit, error) {
+	if !commitRegex.MatchString(hash) {
+		return nil, fmt.Errorf("invalid commit %s", hash)
+	}
+	out, err := run(r.workTree, restrictedEnv, "show", "--no-patch", "--format=%T%n%P%n%cI", hash)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		return nil, fmt.Errorf("unexpected output of git show: %q", out)
+	}
+	t, err := time.Parse(time.RFC3339, lines[2])
+	if err != nil {
+		return nil, err
+	}
+	return &Commit{Hash: hash, Tree: lines[0], Parents: strings.Fields(lines[1]), Time: t}, nil
+}
+
+// NearestTag returns the tag closest to the given commit (empty if no tag is reachable)
+func (r *Repository) NearestTag(hash string) (string, error) {
+	if !commitRegex.MatchString(hash) {
+		return "", fmt.Errorf("invalid commit %s", hash)
+	}
+	// describe fails without reachable tags
+	tags, err := run(r.workTree, restrictedEnv, "tag", "--list", "--merged", hash)
+	if err != nil || strings.TrimSpace(tags) == "" {
+		return "", err
+	}
+	tag, err := run(r.workTree, restrictedEnv, "describe", "--tags", "--abbrev=0", hash)
+	return strings.TrimSpace(tag), err
+}
+
+// Changes returns the paths of tracked files which differ between HEAD, the index and the work tree.
+// Untracked files are not considered.
+func (r *Repository) Changes() ([]string, error) {
+	out, err := run(r.workTree, restrictedEnv, "status", "--porcelain", "-z", "--untracked-files=no", "--no-renames")
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, entry := range strings.Split(out, "\x00") {
+		// XY <path>
+		if len(entry) > 3 {
+			paths = append(paths, entry[3:])
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
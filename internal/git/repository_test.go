@@ -0,0 +1,269 @@
+package git
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runs git within the directory with a fixed identity and without user configuration, returns the output
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=subst",
+		"GIT_AUTHOR_EMAIL=subst@example.com",
+		"GIT_COMMITTER_NAME=subst",
+		"GIT_COMMITTER_EMAIL=subst@example.com",
+		// Commits are created with a +02:00 offset (POSIX format, no timezone database required)
+		"TZ=CEST-2",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// creates a repository with three commits on main: v1 (lightweight tag), v2 (annotated tag) and HEAD
+func fixture(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not available")
+	}
+	dir := t.TempDir()
+	gitCmd(t, dir, "init", "--quiet", "--initial-branch", "main")
+
+	var data strings.Builder
+	for i := 0; i < 200; i++ {
+		data.WriteString("line " + strings.Repeat("x", i%40) + "\n")
+	}
+	writeFile(t, dir, "data.txt", data.String())
+	writeFile(t, dir, "a/b.yaml", "key: value\n")
+	gitCmd(t, dir, "add", "--all")
+	gitCmd(t, dir, "commit", "--quiet", "--message", "first")
+	gitCmd(t, dir, "tag", "v1")
+
+	writeFile(t, dir, "data.txt", data.String()+"second\n")
+	gitCmd(t, dir, "commit", "--quiet", "--all", "--message", "second")
+	gitCmd(t, dir, "tag", "--annotate", "v2", "--message", "release v2")
+
+	writeFile(t, dir, "data.txt", "third\n"+data.String()+"second\n")
+	writeFile(t, dir, "c.txt", "c\n")
+	gitCmd(t, dir, "add", "--all")
+	gitCmd(t, dir, "commit", "--quiet", "--message", "third")
+	return dir
+}
+
+func TestRepository(t *testing.T) {
+	tests := []struct {
+		name string
+		// Commands applied to the fixture
+		setup  [][]string
+		branch string
+	}{
+		{name: "loose", branch: "main"},
+		{
+			name:   "packed",
+			setup:  [][]string{{"repack", "-a", "-d", "-q"}},
+			branch: "main",
+		},
+		{
+			name:   "packed refs",
+			setup:  [][]string{{"pack-refs", "--all"}},
+			branch: "main",
+		},
+		{
+			name:  "detached",
+			setup: [][]string{{"checkout", "--quiet", "--detach"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fixture(t)
+			for _, args := range tt.setup {
+				gitCmd(t, dir, args...)
+			}
+			// Subdirectories resolve to the repository
+			r, err := Open(filepath.Join(dir, "a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.WorkTree() != dir {
+				t.Errorf("WorkTree() = %s, %s expected", r.WorkTree(), dir)
+			}
+
+			branch, hash, err := r.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := gitCmd(t, dir, "rev-parse", "HEAD"); hash != want || branch != tt.branch {
+				t.Errorf("Head() = %q, %q, %q %q expected", branch, hash, tt.branch, want)
+			}
+
+			commit, err := r.Commit(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := gitCmd(t, dir, "rev-parse", "HEAD^{tree}"); commit.Tree != want {
+				t.Errorf("Tree = %s, %s expected", commit.Tree, want)
+			}
+			if want := gitCmd(t, dir, "rev-parse", "HEAD^"); len(commit.Parents) != 1 || commit.Parents[0] != want {
+				t.Errorf("Parents = %v, [%s] expected", commit.Parents, want)
+			}
+			// The timezone of the committer is kept
+			if got, want := commit.Time.Format(time.RFC3339), gitCmd(t, dir, "log", "-1", "--format=%cI", hash); got != want || !strings.HasSuffix(got, "+02:00") {
+				t.Errorf("Time = %s, %s expected", got, want)
+			}
+
+			first := gitCmd(t, dir, "rev-parse", "HEAD~2")
+			for _, tag := range []struct{ commit, want string }{
+				{hash, "v2"},
+				{first, "v1"},
+			} {
+				got, err := r.NearestTag(tag.commit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tag.want {
+					t.Errorf("NearestTag(%s) = %q, %q expected", tag.commit, got, tag.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenNotRepository(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), ".git")); err == nil {
+		t.Skip("temporary directory is within a repository")
+	}
+	if _, err := Open(dir); err != ErrNotRepository {
+		t.Errorf("Open() = %v, %v expected", err, ErrNotRepository)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		// Modification of the fixture
+		setup func(t *testing.T, dir string)
+		want  []string
+	}{
+		{
+			name:  "clean",
+			setup: func(t *testing.T, dir string) {},
+			want:  []string{},
+		},
+		{
+			name:  "modified",
+			setup: func(t *testing.T, dir string) { writeFile(t, dir, "a/b.yaml", "key: other value\n") },
+			want:  []string{"a/b.yaml"},
+		},
+		{
+			name: "modified with same size",
+			setup: func(t *testing.T, dir string) {
+				writeFile(t, dir, "c.txt", "d\n")
+				// Different stat information forces the comparison of the content
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(filepath.Join(dir, "c.txt"), later, later); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"c.txt"},
+		},
+		{
+			name: "touched",
+			setup: func(t *testing.T, dir string) {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(filepath.Join(dir, "c.txt"), later, later); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{},
+		},
+		{
+			name: "staged",
+			setup: func(t *testing.T, dir string) {
+				writeFile(t, dir, "c.txt", "staged\n")
+				gitCmd(t, dir, "add", "c.txt")
+			},
+			want: []string{"c.txt"},
+		},
+		{
+			name: "deleted",
+			setup: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, "c.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"c.txt"},
+		},
+		{
+			name:  "removed from index",
+			setup: func(t *testing.T, dir string) { gitCmd(t, dir, "rm", "--quiet", "--cached", "c.txt") },
+			want:  []string{"c.txt"},
+		},
+		{
+			name:  "untracked",
+			setup: func(t *testing.T, dir string) { writeFile(t, dir, "untracked.txt", "new\n") },
+			want:  []string{},
+		},
+		{
+			name: "fsmonitor of the repository",
+			setup: func(t *testing.T, dir string) {
+				gitCmd(t, dir, "config", "core.fsmonitor", "touch "+filepath.Join(dir, "executed")+"; false")
+				writeFile(t, dir, "a/b.yaml", "key: other value\n")
+			},
+			want: []string{"a/b.yaml"},
+		},
+		{
+			name: "index version 4",
+			setup: func(t *testing.T, dir string) {
+				gitCmd(t, dir, "update-index", "--index-version", "4")
+				writeFile(t, dir, "a/b.yaml", "key: other value\n")
+			},
+			want: []string{"a/b.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fixture(t)
+			tt.setup(t, dir)
+
+			r, err := Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.Changes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Changes() = %v, %v expected", got, tt.want)
+			}
+			// Commands configured by the repository are not executed
+			if _, err := os.Stat(filepath.Join(dir, "executed")); err == nil {
+				t.Error("fsmonitor of the repository executed")
+			}
+		})
+	}
+}
@@ -1,29 +1,106 @@
 package kustomize
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/fs"
-	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
+	gitignore "github.com/monochromegane/go-gitignore"
+	"github.com/sirupsen/logrus"
 	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/api/resmap"
 	kustypes "sigs.k8s.io/kustomize/api/types"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
 )
 
 type Kustomize struct {
 	Root  string
 	Paths []string
 	Build resmap.ResMap
+	opts  Options
+	fs    filesys.FileSystem
+	// Kustomization files with helm charts but without chart home
+	helmKustomizations []string
+	// Preprocessed kustomization files (served from memory for the build)
+	overrides map[string][]byte
+	// Directories of referenced files (which are not paths)
+	inputs []string
+	// References remote resources (git)
+	remote bool
+	// Ignore unresolvable references during path discovery
+	tolerant bool
 }
 
-func NewKustomize(root string) (*Kustomize, error) {
-	k := &Kustomize{Root: root}
+type Options struct {
+	// Fetch remote resources (git) to walk them for substitution files, otherwise they are skipped
+	RemoteResources bool
+	// Directory to cache remote resources
+	CacheDir string
+	// Only use cached remote resources
+	Offline bool
+	// Walk subdirectories of the paths
+	Recursive bool
+	// Maximum depth of subdirectories to walk (0 is unlimited)
+	MaxDepth int
+
+	// Build options (see kustomize build)
+
+	// Restrictions for loading files: LoadRestrictionsRootOnly or LoadRestrictionsNone (default)
+	LoadRestrictor string
+	// Enable kustomize plugins and KRM functions
+	EnableAlphaPlugins bool
+	// Enable exec KRM functions (requires EnableAlphaPlugins)
+	EnableExec bool
+	// Enable helm chart inflation
+	EnableHelm bool
+	// Helm binary used for chart inflation
+	HelmCommand string
+	// Directory to pull helm charts to, used for kustomizations without helmGlobals.chartHome
+	HelmChartHome string
+	// Add app.kubernetes.io/managed-by label to all resources
+	AddManagedbyLabel bool
+	// Order of the resources: legacy or none (default)
+	Reorder string
+
+	// Evaluates the content of kustomization files before they are parsed and built
+	Preprocess func(path string, data []byte) ([]byte, error)
+	// Filesystem used for discovery, walking and the build (defaults to disk)
+	FileSystem filesys.FileSystem
+}
+
+func newKustomize(root string, opts Options) *Kustomize {
+	k := &Kustomize{Root: root, opts: opts, fs: opts.FileSystem, overrides: make(map[string][]byte)}
+	if k.fs == nil {
+		k.fs = filesys.MakeFsOnDisk()
+	}
+	return k
+}
+
+func NewKustomize(root string, opts Options) (*Kustomize, error) {
+	k := newKustomize(root, opts)
+	if err := k.paths(root); err != nil {
+		return nil, err
+	}
+	if err := k.addPath(root); err != nil {
+		return nil, err
+	}
 	if err := k.build(); err != nil {
 		return nil, err
 	}
+	return k, nil
+}
+
+// Discover collects the paths of the kustomization without building it. References which can't be resolved
+// (eg. they are evaluated by Preprocess) and kustomizations which can't be parsed are skipped
+func Discover(root string, opts Options) (*Kustomize, error) {
+	k := newKustomize(root, opts)
+	k.tolerant = true
 	if err := k.paths(root); err != nil {
 		return nil, err
 	}
@@ -49,59 +126,312 @@ func (k *Kustomize) addPath(path string) error {
 	return nil
 }
 
+// Collects the paths of the kustomization. Paths are added by precedence (lowest first):
+//
+//  1. Directories of generator files and envs (configMapGenerator, secretGenerator)
+//  2. Directories of patchesJson6902
+//  3. Directories of patchesStrategicMerge
+//  4. Directories of patches
+//  5. Resources (directories are resolved recursively), in given order
+//  6. Bases (legacy, resolved like resources), in given order
+//  7. Components (resolved recursively), in given order
+//
+// The directories of other files read by the build (eg. transformers, helm values) are only inputs (see Dirs)
 func (k *Kustomize) paths(path string) error {
 	path = convertPath(path)
-	kz, err := kustomizeFile(path)
+	kz, kzPath, err := k.kustomization(path)
 	if err != nil {
-		return err
+		return k.unresolved(path, err)
+	}
+
+	if k.opts.HelmChartHome != "" && (len(kz.HelmCharts) > 0 || len(kz.HelmChartInflationGenerator) > 0) &&
+		(kz.HelmGlobals == nil || kz.HelmGlobals.ChartHome == "") {
+		k.helmKustomizations = append(k.helmKustomizations, kzPath)
+	}
+
+	for _, dir := range generatorDirs(kz) {
+		if err := k.addFileDir(path, dir); err != nil {
+			return err
+		}
+	}
+
+	for _, patch := range kz.PatchesJson6902 {
+		if patch.Path == "" {
+			continue
+		}
+		if err := k.addFileDir(path, patch.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, patch := range kz.PatchesStrategicMerge {
+		// Inline patches are not paths
+		if strings.Contains(string(patch), "\n") {
+			continue
+		}
+		if err := k.addFileDir(path, string(patch)); err != nil {
+			return err
+		}
 	}
 
 	for _, patch := range kz.Patches {
-		if err := k.addPath(filepath.Join(path, filepath.Dir(patch.Path))); err != nil {
+		if patch.Path == "" {
+			continue
+		}
+		if err := k.addFileDir(path, patch.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range inputFiles(kz) {
+		if err := k.addInput(path, file); err != nil {
 			return err
 		}
 	}
 
 	for _, resource := range kz.Resources {
-		p := filepath.Join(path, resource)
-		file, err := os.Stat(p)
-		if err != nil {
+		if err := k.addKustomization(path, resource); err != nil {
 			return err
 		}
-		if file.IsDir() {
-			p = convertPath(p)
-			if err := k.paths(p); err != nil {
-				return err
+	}
+
+	for _, base := range kz.Bases {
+		if err := k.addKustomization(path, base); err != nil {
+			return err
+		}
+	}
+
+	for _, component := range kz.Components {
+		if err := k.addKustomization(path, component); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the directory of a file referenced by the kustomization
+func (k *Kustomize) addFileDir(path string, file string) error {
+	p := filepath.Join(path, file)
+	isDir, err := k.isDir(p)
+	if err != nil {
+		return k.unresolved(file, err)
+	}
+	if !isDir {
+		p = filepath.Dir(p)
+	}
+	return k.addPath(p)
+}
+
+// Adds the directory of a file which is read by the build, but not searched for substitution files
+func (k *Kustomize) addInput(path string, file string) error {
+	p := filepath.Join(path, file)
+	isDir, err := k.isDir(p)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || !isRemote(file) {
+			return k.unresolved(file, err)
+		}
+		k.remote = true
+		return nil
+	}
+	if !isDir {
+		p = filepath.Dir(p)
+	}
+	k.inputs = append(k.inputs, p)
+	return nil
+}
+
+// Resolves a referenced kustomization (resource, base or component) if it's a directory
+func (k *Kustomize) addKustomization(path string, ref string) error {
+	p := filepath.Join(path, ref)
+	isDir, err := k.isDir(p)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || !isRemote(ref) {
+			return k.unresolved(ref, err)
+		}
+		// Remote resources are fetched to disk
+		k.remote = true
+		if isRemoteFile(ref) || !k.opts.RemoteResources || !OnDisk(k.fs) {
+			logrus.Debugf("skipping remote resource %s", ref)
+			return nil
+		}
+		if p, err = k.fetchRemote(ref); err != nil {
+			return err
+		}
+		if isDir, err = k.isDir(p); err != nil {
+			return err
+		}
+	}
+	if isDir {
+		p = convertPath(p)
+		if err := k.paths(p); err != nil {
+			return err
+		}
+		if err := k.addPath(p); err != nil {
+			return err
+		}
+	} else {
+		k.inputs = append(k.inputs, filepath.Dir(p))
+	}
+	return nil
+}
+
+// Remote reports whether the kustomization references remote resources
+func (k *Kustomize) Remote() bool {
+	return k.remote
+}
+
+// Dirs returns the directories the build depends on: the paths, the directories of referenced files and
+// (in recursive mode) the subdirectories of the paths
+func (k *Kustomize) Dirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, p := range k.Paths {
+		add(p)
+		if !k.opts.Recursive {
+			continue
+		}
+		_ = filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() || path == p {
+				return nil
 			}
-			if err := k.addPath(p); err != nil {
-				return err
+			if strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
 			}
+			add(path)
+			return nil
+		})
+	}
+	for _, dir := range k.inputs {
+		add(dir)
+	}
+	return dirs
+}
+
+// Reads the kustomization within path and applies the preprocessing
+func (k *Kustomize) kustomization(path string) (kz kustypes.Kustomization, kzPath string, err error) {
+	kzPath, err = k.kustomizeFile(path)
+	if err != nil {
+		return kz, kzPath, err
+	}
+	data, err := k.fs.ReadFile(kzPath)
+	if err != nil {
+		return kz, kzPath, err
+	}
+
+	if k.opts.Preprocess != nil {
+		processed, err := k.opts.Preprocess(kzPath, data)
+		if err != nil {
+			return kz, kzPath, fmt.Errorf("failed to evaluate %s: %w", kzPath, err)
+		}
+		if !bytes.Equal(processed, data) {
+			logrus.Debugf("evaluated kustomization %s", kzPath)
+			k.overrides[filepath.Clean(kzPath)] = processed
+			data = processed
 		}
 	}
+
+	err = kz.Unmarshal(data)
+	return kz, kzPath, err
+}
+
+// Returns the error, unless references are resolved tolerant
+func (k *Kustomize) unresolved(ref string, err error) error {
+	if !k.tolerant {
+		return err
+	}
+	logrus.Debugf("skipping unresolved %s: %s", ref, err)
 	return nil
 }
 
+// Walk calls fn for each file within the paths (in order of the paths). Files matching the patterns
+// in a .substignore file (located in the path) are skipped. In recursive mode the subdirectories
+// are walked (by name) before the files of the directory itself, so files closer to the path have precedence
 func (k *Kustomize) Walk(fn func(path string, f fs.FileInfo) error) error {
 	for _, path := range k.Paths {
-		files, err := os.ReadDir(path)
+		ignore, err := k.ignoreMatcher(path)
 		if err != nil {
 			return err
 		}
-		for _, entry := range files {
-			file, err := entry.Info()
-			if err != nil {
-				return err
+		if err := k.walkDir(path, 0, ignore, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Kustomize) walkDir(dir string, depth int, ignore gitignore.IgnoreMatcher, fn func(path string, f fs.FileInfo) error) error {
+	entries, err := k.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Strings(entries)
+
+	var files []fs.FileInfo
+	for _, entry := range entries {
+		full := filepath.Join(dir, entry)
+		isDir := k.fs.IsDir(full)
+		if ignore.Match(full, isDir) {
+			logrus.Debug("ignoring: ", full)
+			continue
+		}
+
+		if isDir {
+			if !k.opts.Recursive || (k.opts.MaxDepth > 0 && depth+1 > k.opts.MaxDepth) || k.skipDir(full) {
+				continue
 			}
-			if err := fn(path, file); err != nil {
+			if err := k.walkDir(full, depth+1, ignore, fn); err != nil {
 				return err
 			}
+			continue
+		}
+
+		file, err := k.stat(full)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	for _, file := range files {
+		if err := fn(dir, file); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// Skips hidden directories and directories which are kustomizations themselves (walked when referenced)
+func (k *Kustomize) skipDir(dir string) bool {
+	if strings.HasPrefix(filepath.Base(dir), ".") {
+		return true
+	}
+	for _, p := range k.Paths {
+		if p == filepath.Clean(dir) {
+			return true
+		}
+	}
+	_, err := k.kustomizeFile(dir)
+	return err == nil
+}
+
 func (k *Kustomize) build() (err error) {
-	fs := filesys.MakeFsOnDisk()
+	buildOptions, err := k.buildOptions()
+	if err != nil {
+		return err
+	}
+
+	fSys, err := k.filesystem()
+	if err != nil {
+		return err
+	}
 
 	kustomizeBuildMutex.Lock()
 	defer kustomizeBuildMutex.Unlock()
@@ -112,13 +442,96 @@ func (k *Kustomize) build() (err error) {
 		}
 	}()
 
-	buildOptions := &krusty.Options{
-		LoadRestrictions: kustypes.LoadRestrictionsNone,
-		PluginConfig:     kustypes.EnabledPluginConfig(kustypes.BuiltinPluginLoadingOptions(kustypes.PluginRestrictionsNone)),
-	}
-
 	b := krusty.MakeKustomizer(buildOptions)
 
-	k.Build, err = b.Run(fs, k.Root)
+	k.Build, err = b.Run(fSys, k.Root)
 	return err
 }
+
+// returns the krusty options
+func (k *Kustomize) buildOptions() (*krusty.Options, error) {
+	opts := &krusty.Options{
+		AddManagedbyLabel: k.opts.AddManagedbyLabel,
+	}
+
+	switch k.opts.LoadRestrictor {
+	case "", kustypes.LoadRestrictionsNone.String():
+		opts.LoadRestrictions = kustypes.LoadRestrictionsNone
+	case kustypes.LoadRestrictionsRootOnly.String():
+		opts.LoadRestrictions = kustypes.LoadRestrictionsRootOnly
+	default:
+		return nil, fmt.Errorf("invalid load restrictor %q", k.opts.LoadRestrictor)
+	}
+
+	switch k.opts.Reorder {
+	case "", string(krusty.ReorderOptionNone):
+		opts.Reorder = krusty.ReorderOptionNone
+	case string(krusty.ReorderOptionLegacy):
+		opts.Reorder = krusty.ReorderOptionLegacy
+	default:
+		return nil, fmt.Errorf("invalid reorder option %q", k.opts.Reorder)
+	}
+
+	if k.opts.EnableAlphaPlugins {
+		opts.PluginConfig = kustypes.EnabledPluginConfig(kustypes.BploLoadFromFileSys)
+		opts.PluginConfig.FnpLoadingOptions.EnableExec = k.opts.EnableExec
+	} else {
+		opts.PluginConfig = kustypes.DisabledPluginConfig()
+	}
+	opts.PluginConfig.HelmConfig.Enabled = k.opts.EnableHelm
+	opts.PluginConfig.HelmConfig.Command = k.opts.HelmCommand
+	if opts.PluginConfig.HelmConfig.Command == "" {
+		opts.PluginConfig.HelmConfig.Command = "helm"
+	}
+
+	return opts, nil
+}
+
+// returns the filesystem for the build. Preprocessed kustomizations and kustomizations with helm charts
+// (with the chart home) are served from memory
+func (k *Kustomize) filesystem() (filesys.FileSystem, error) {
+	if len(k.helmKustomizations) == 0 && len(k.overrides) == 0 {
+		return k.fs, nil
+	}
+
+	overlay := newOverlayFs(k.fs)
+	for path, data := range k.overrides {
+		if err := overlay.Overwrite(path, data); err != nil {
+			return nil, err
+		}
+	}
+	if len(k.helmKustomizations) == 0 {
+		return overlay, nil
+	}
+
+	chartHome, err := filepath.Abs(k.opts.HelmChartHome)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range k.helmKustomizations {
+		data, err := overlay.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		kz := make(map[string]interface{})
+		if err := yaml.Unmarshal(data, &kz); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		globals, _ := kz["helmGlobals"].(map[string]interface{})
+		if globals == nil {
+			globals = make(map[string]interface{})
+		}
+		globals["chartHome"] = chartHome
+		kz["helmGlobals"] = globals
+
+		if data, err = yaml.Marshal(kz); err != nil {
+			return nil, err
+		}
+		if err := overlay.Overwrite(path, data); err != nil {
+			return nil, err
+		}
+		logrus.Debugf("using chart home %s for %s", chartHome, path)
+	}
+	return overlay, nil
+}
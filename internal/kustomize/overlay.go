@@ -0,0 +1,49 @@
+package kustomize
+
+import (
+	"path/filepath"
+
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// Filesystem which serves modified files (eg. kustomizations) from memory and everything else from the base
+type overlayFs struct {
+	filesys.FileSystem
+	memory   filesys.FileSystem
+	override map[string]bool
+}
+
+func newOverlayFs(base filesys.FileSystem) *overlayFs {
+	return &overlayFs{
+		FileSystem: base,
+		memory:     filesys.MakeFsInMemory(),
+		override:   make(map[string]bool),
+	}
+}
+
+// Overwrite the content of the file at path (only in memory)
+func (o *overlayFs) Overwrite(path string, data []byte) error {
+	path = filepath.Clean(path)
+	if err := o.memory.MkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := o.memory.WriteFile(path, data); err != nil {
+		return err
+	}
+	o.override[path] = true
+	return nil
+}
+
+func (o *overlayFs) Open(path string) (filesys.File, error) {
+	if o.override[filepath.Clean(path)] {
+		return o.memory.Open(filepath.Clean(path))
+	}
+	return o.FileSystem.Open(path)
+}
+
+func (o *overlayFs) ReadFile(path string) ([]byte, error) {
+	if o.override[filepath.Clean(path)] {
+		return o.memory.ReadFile(filepath.Clean(path))
+	}
+	return o.FileSystem.ReadFile(path)
+}
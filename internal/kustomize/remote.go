@@ -0,0 +1,194 @@
+package kustomize
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/buttahtoast/subst/internal/git"
+	"github.com/sirupsen/logrus"
+)
+
+// Host prefixes which kustomize resolves as git repositories without scheme
+var remoteHosts = []string{"github.com/", "gitlab.com/", "bitbucket.org/"}
+
+// remote kustomization reference (eg. github.com/org/repo//base?ref=v1)
+type remote struct {
+	Repository string
+	Path       string
+	Ref        string
+}
+
+// Verifies if the resource references a remote kustomization (only git references, no single files)
+func isRemote(resource string) bool {
+	r := strings.TrimPrefix(resource, "git::")
+	if strings.HasPrefix(r, "git@") || strings.HasPrefix(r, "ssh://") || strings.HasPrefix(r, "file://") {
+		return true
+	}
+	for _, host := range remoteHosts {
+		if strings.HasPrefix(r, host) {
+			return true
+		}
+	}
+	return strings.Contains(r, "://")
+}
+
+// Verifies if the remote resource is a single file (eg. https://example.com/manifest.yaml)
+func isRemoteFile(resource string) bool {
+	if !strings.HasPrefix(resource, "https://") && !strings.HasPrefix(resource, "http://") {
+		return false
+	}
+	u, err := url.Parse(resource)
+	if err != nil {
+		return false
+	}
+	if strings.Contains(strings.TrimPrefix(resource, u.Scheme+"://"), "//") {
+		return false
+	}
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// Parses remote references in the kustomize format: <repository>[//<path>][?ref=<ref>]
+func parseRemote(resource string) (*remote, error) {
+	r := strings.TrimPrefix(resource, "git::")
+	rm := &remote{}
+
+	if i := strings.Index(r, "?"); i >= 0 {
+		query, err := url.ParseQuery(r[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote resource %s: %w", resource, err)
+		}
+		rm.Ref = query.Get("ref")
+		if rm.Ref == "" {
+			rm.Ref = query.Get("version")
+		}
+		r = r[:i]
+	}
+
+	// Path separator after the scheme
+	offset := 0
+	if i := strings.Index(r, "://"); i >= 0 {
+		offset = i + 3
+	}
+	if i := strings.Index(r[offset:], "//"); i >= 0 {
+		rm.Repository = r[:offset+i]
+		rm.Path = r[offset+i+2:]
+	} else if i := strings.Index(r, ".git/"); i >= 0 {
+		rm.Repository = r[:i+4]
+		rm.Path = r[i+5:]
+	} else {
+		rm.Repository = r
+		for _, host := range remoteHosts {
+			// <host>/<org>/<repo>/<path>
+			if rest := strings.TrimPrefix(r, host); rest != r {
+				parts := strings.SplitN(rest, "/", 3)
+				if len(parts) == 3 {
+					rm.Repository = host + parts[0] + "/" + parts[1]
+					rm.Path = parts[2]
+				}
+			}
+		}
+	}
+
+	for _, host := range remoteHosts {
+		if strings.HasPrefix(rm.Repository, host) {
+			rm.Repository = "https://" + rm.Repository
+		}
+	}
+	if rm.Repository == "" {
+		return nil, fmt.Errorf("invalid remote resource %s", resource)
+	}
+	rm.Path = path.Clean("/" + rm.Path)[1:]
+	return rm, nil
+}
+
+// Fetches the remote kustomization into the cache and returns the local directory
+func (k *Kustomize) fetchRemote(resource string) (string, error) {
+	rm, err := parseRemote(resource)
+	if err != nil {
+		return "", err
+	}
+	// The reference is controlled by the repository
+	if err := git.ValidateRemote(rm.Repository, rm.Ref); err != nil {
+		return "", fmt.Errorf("remote resource %s: %w", resource, err)
+	}
+	sum := sha256.Sum256([]byte(rm.Repository + "@" + git.NormalizeRef(rm.Ref)))
+	entry := filepath.Join(k.opts.CacheDir, "git", hex.EncodeToString(sum[:]))
+
+	logrus.Debugf("fetching remote resource %s", resource)
+	dir, err := git.Fetch(rm.Repository, rm.Ref, entry, k.opts.Offline)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch remote resource %s: %w", resource, err)
+	}
+	return filepath.Join(dir, filepath.FromSlash(rm.Path)), nil
+}
+
+// IsRepository verifies if the path references a kustomization within a git repository
+// (eg. git::https://host/repo.git//path?ref=v1) or a local bare repository, instead of a local directory
+func IsRepository(path string) bool {
+	if isRemote(path) && !isRemoteFile(path) {
+		return true
+	}
+	rm, err := parseRemote(path)
+	if err != nil {
+		return false
+	}
+	return isBareRepository(rm.Repository)
+}
+
+// verifies if the directory is a bare git repository
+func isBareRepository(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return os.IsNotExist(err)
+}
+
+// Workspace checks out the referenced repository (see IsRepository) into a temporary directory. Returns
+// the directory of the kustomization within the checkout and a function to remove the checkout
+func Workspace(path string) (dir string, cleanup func(), err error) {
+	rm, err := parseRemote(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if isBareRepository(rm.Repository) {
+		if rm.Repository, err = filepath.Abs(rm.Repository); err != nil {
+			return "", nil, err
+		}
+	}
+
+	tmp, err := os.MkdirTemp("", "subst-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() {
+		if err := os.RemoveAll(tmp); err != nil {
+			logrus.Warnf("failed to remove workspace %s: %s", tmp, err)
+		}
+	}
+
+	logrus.Debugf("checking out %s@%s to %s", rm.Repository, rm.Ref, tmp)
+	if err := git.FetchLocal(rm.Repository, rm.Ref, tmp); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to check out %s: %w", path, err)
+	}
+
+	dir = filepath.Join(tmp, filepath.FromSlash(rm.Path))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		cleanup()
+		return "", nil, fmt.Errorf("path %s not found in %s", rm.Path, rm.Repository)
+	}
+	return dir, cleanup, nil
+}
@@ -1,12 +1,22 @@
 package kustomize
 
 import (
+	"bytes"
 	"fmt"
-	"os"
+	"io/fs"
 	"path/filepath"
+	"reflect"
+	"strings"
 
+	gitignore "github.com/monochromegane/go-gitignore"
 	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+const (
+	// File with patterns (gitignore format) of files to ignore when walking a path
+	ignoreFile = ".substignore"
 )
 
 func convertPath(path string) string {
@@ -17,19 +27,112 @@ func convertPath(path string) string {
 	return path
 }
 
-func kustomizeFile(path string) (types.Kustomization, error) {
-	kz := types.Kustomization{}
+// OnDisk verifies if the filesystem is the disk
+func OnDisk(fSys filesys.FileSystem) bool {
+	return reflect.TypeOf(fSys) == reflect.TypeOf(filesys.MakeFsOnDisk())
+}
+
+// IsKustomization verifies if the directory contains a kustomization file
+func IsKustomization(fSys filesys.FileSystem, dir string) bool {
+	k := &Kustomize{fs: fSys}
+	_, err := k.kustomizeFile(dir)
+	return err == nil
+}
+
+// Returns if the path is a directory, errors if the path does not exist
+func (k *Kustomize) isDir(path string) (bool, error) {
+	if !k.fs.Exists(path) {
+		return false, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return k.fs.IsDir(path), nil
+}
+
+// Returns the file info of the path
+func (k *Kustomize) stat(path string) (fs.FileInfo, error) {
+	f, err := k.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// Returns the path of the kustomization file within path
+func (k *Kustomize) kustomizeFile(path string) (string, error) {
 	for _, kfilename := range konfig.RecognizedKustomizationFileNames() {
 		fullPath := filepath.Join(path, kfilename)
-		if _, err := os.Stat(fullPath); err == nil {
-			kzBytes, err := os.ReadFile(fullPath)
-			if err != nil {
-				return kz, err
+		if k.fs.Exists(fullPath) && !k.fs.IsDir(fullPath) {
+			return fullPath, nil
+		}
+	}
+	return "", fmt.Errorf("no kustomization file found in %v", path)
+}
+
+// Returns the files and env files referenced by generators
+func generatorDirs(kz types.Kustomization) (dirs []string) {
+	var sources []types.KvPairSources
+	for _, g := range kz.ConfigMapGenerator {
+		sources = append(sources, g.KvPairSources)
+	}
+	for _, g := range kz.SecretGenerator {
+		sources = append(sources, g.KvPairSources)
+	}
+
+	for _, src := range sources {
+		for _, f := range src.FileSources {
+			// Format: [{key}=]{path}
+			if i := strings.Index(f, "="); i >= 0 {
+				f = f[i+1:]
 			}
-			err = kz.Unmarshal(kzBytes)
+			dirs = append(dirs, f)
+		}
+		dirs = append(dirs, src.EnvSources...)
+		if src.EnvSource != "" {
+			dirs = append(dirs, src.EnvSource)
+		}
+	}
+	return dirs
+}
 
-			return kz, err
+// Returns the files read by the build which are neither generator files nor patches: transformers, generators,
+// validators, replacements, configurations, crds, the openapi schema and helm values files (inline entries are skipped)
+func inputFiles(kz types.Kustomization) (files []string) {
+	var refs []string
+	refs = append(refs, kz.Transformers...)
+	refs = append(refs, kz.Generators...)
+	refs = append(refs, kz.Validators...)
+	for _, r := range kz.Replacements {
+		refs = append(refs, r.Path)
+	}
+	refs = append(refs, kz.Configurations...)
+	refs = append(refs, kz.Crds...)
+	refs = append(refs, kz.OpenAPI["path"])
+	for _, chart := range kz.HelmCharts {
+		refs = append(refs, chart.ValuesFile)
+		refs = append(refs, chart.AdditionalValuesFiles...)
+	}
+	for _, chart := range kz.HelmChartInflationGenerator {
+		refs = append(refs, chart.Values)
+	}
+
+	for _, ref := range refs {
+		if ref == "" || strings.Contains(ref, "\n") {
+			continue
 		}
+		files = append(files, ref)
+	}
+	return files
+}
+
+// Returns the matcher for the .substignore file in the path (matches nothing if absent)
+func (k *Kustomize) ignoreMatcher(path string) (gitignore.IgnoreMatcher, error) {
+	file := filepath.Join(path, ignoreFile)
+	if !k.fs.Exists(file) {
+		return gitignore.DummyIgnoreMatcher(false), nil
+	}
+	data, err := k.fs.ReadFile(file)
+	if err != nil {
+		return nil, err
 	}
-	return kz, fmt.Errorf("no kustomization file found in %v", path)
+	return gitignore.NewGitIgnoreFromReader(path, bytes.NewReader(data)), nil
 }
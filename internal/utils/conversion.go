@@ -71,6 +71,27 @@ func ParseYAML(data []byte) (map[interface{}]interface{}, error) {
 	return doc, nil
 }
 
+// Marshal returns the documents in the output format (yaml stream or one json document per line)
+func Marshal(docs []map[interface{}]interface{}, output string) ([]byte, error) {
+	var out []byte
+	for _, doc := range docs {
+		if output == "json" {
+			j, err := json.MarshalIndent(mapify(doc), "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			out = append(append(out, j...), '\n')
+			continue
+		}
+		y, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		out = append(append(out, "---\n"...), y...)
+	}
+	return out, nil
+}
+
 // create a golang function which prints map[interface{}]interface{} as yaml
 func PrintYAML(data map[interface{}]interface{}) error {
 	y, err := yaml.Marshal(data)
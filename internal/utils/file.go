@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/yaml.v2"
 )
@@ -28,6 +29,11 @@ func NewFile(path string) (*File, error) {
 	return &File{data: data, Path: path}, nil
 }
 
+// NewFileFromBytes creates a file from data which is not read from disk (eg. remote sources)
+func NewFileFromBytes(path string, data []byte) *File {
+	return &File{data: data, Path: path}
+}
+
 func (f *File) OverwriteDataByte(data []byte) {
 	f.data = data
 }
@@ -59,3 +65,43 @@ func (f *File) JSON() ([]byte, error) {
 func (f *File) SPRUCE() (map[interface{}]interface{}, error) {
 	return ParseYAML(f.Byte())
 }
+
+// Format returns the detected format of the file
+func (f *File) Format() string {
+	return DetectFormat(f.Path, f.data)
+}
+
+// Parse the file based on its format
+func (f *File) Parse() (map[interface{}]interface{}, error) {
+	return ParseFormat(f.Format(), f.data)
+}
+
+// Template renders the file as template and parses the result based on its format
+func (f *File) Template(values map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	data, err := Render(f.data, values)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFormat(f.Format(), data)
+}
+
+// WriteFileAtomic writes the file through a temporary file within the same directory, concurrent
+// readers either see the previous or the complete new content
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
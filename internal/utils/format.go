@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/magiconair/properties"
+	"github.com/subosito/gotenv"
+)
+
+// Supported file formats
+const (
+	FormatYAML       = "yaml"
+	FormatJSON       = "json"
+	FormatTOML       = "toml"
+	FormatDotenv     = "dotenv"
+	FormatProperties = "properties"
+)
+
+var (
+	dotenvLineRegex = regexp.MustCompile(`^(export\s+)?[A-Za-z_][A-Za-z0-9_.]*=`)
+)
+
+// Detects the format by the file extension, falls back to the content
+func DetectFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json", ".ejson":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	case ".env":
+		return FormatDotenv
+	case ".properties":
+		return FormatProperties
+	}
+	return detectContentFormat(data)
+}
+
+// Guesses the format based on the content, defaults to yaml
+func detectContentFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return FormatYAML
+	}
+	if trimmed[0] == '{' {
+		return FormatJSON
+	}
+	// Templates are always treated as yaml
+	if bytes.Contains(trimmed, []byte("{{")) {
+		return FormatYAML
+	}
+
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !dotenvLineRegex.MatchString(line) {
+			return FormatYAML
+		}
+	}
+	return FormatDotenv
+}
+
+// Parse data in the given format to a map[interface{}]interface{}
+func ParseFormat(format string, data []byte) (map[interface{}]interface{}, error) {
+	switch format {
+	case FormatTOML:
+		m := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, fmt.Errorf("invalid toml: %w", err)
+		}
+		return normalize(m)
+	case FormatDotenv:
+		env, err := gotenv.StrictParse(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dotenv: %w", err)
+		}
+		out := make(map[interface{}]interface{}, len(env))
+		for k, v := range env {
+			out[k] = v
+		}
+		return out, nil
+	case FormatProperties:
+		l := &properties.Loader{Encoding: properties.UTF8, DisableExpansion: true}
+		p, err := l.LoadBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid properties: %w", err)
+		}
+		return nestProperties(p.Map())
+	default:
+		// JSON is valid YAML
+		return ParseYAML(data)
+	}
+}
+
+// Nests dot separated property keys (app.name=foo becomes app: {name: foo})
+func nestProperties(props map[string]string) (map[interface{}]interface{}, error) {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make(map[interface{}]interface{})
+	for _, key := range keys {
+		path := strings.Split(key, ".")
+		node := out
+		for _, p := range path[:len(path)-1] {
+			switch next := node[p].(type) {
+			case nil:
+				child := make(map[interface{}]interface{})
+				node[p] = child
+				node = child
+			case map[interface{}]interface{}:
+				node = next
+			default:
+				return nil, fmt.Errorf("property %q conflicts with value of %q", key, p)
+			}
+		}
+		leaf := path[len(path)-1]
+		if _, ok := node[leaf].(map[interface{}]interface{}); ok {
+			return nil, fmt.Errorf("property %q conflicts with nested properties", key)
+		}
+		node[leaf] = props[key]
+	}
+	return out, nil
+}
+
+// Converts any decoded structure to the map[interface{}]interface{} tree used by spruce
+func normalize(in interface{}) (map[interface{}]interface{}, error) {
+	j, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	return ParseYAML(j)
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		data string
+		want string
+	}{
+		{name: "yaml extension", path: "subst.yaml", data: "KEY=value\n", want: FormatYAML},
+		{name: "yml extension", path: "subst.YML", data: "{}", want: FormatYAML},
+		{name: "json extension", path: "subst.json", data: "a: b\n", want: FormatJSON},
+		{name: "ejson extension", path: "secrets.ejson", data: "{}", want: FormatJSON},
+		{name: "toml extension", path: "subst.toml", data: "a = 1\n", want: FormatTOML},
+		{name: "env extension", path: "subst.env", data: "a: b\n", want: FormatDotenv},
+		{name: "properties extension", path: "subst.properties", data: "KEY=value\n", want: FormatProperties},
+		{name: "empty content", path: "subst", data: " \n", want: FormatYAML},
+		{name: "json content", path: "subst", data: "\n {\"a\": 1}", want: FormatJSON},
+		{name: "yaml content", path: "subst", data: "a: b\nc:\n- d\n", want: FormatYAML},
+		{name: "dotenv content", path: "subst", data: "# comment\nexport KEY=value\n\nOTHER=\"quoted value\"\n", want: FormatDotenv},
+		// Properties are only detected by the extension
+		{name: "properties content", path: "subst", data: "app.name=value\n", want: FormatDotenv},
+		{name: "mixed content", path: "subst", data: "KEY=value\na: b\n", want: FormatYAML},
+		{name: "yaml value with equal sign", path: "subst", data: "a: b=c\n", want: FormatYAML},
+		{name: "template", path: "subst", data: "KEY={{ .value }}\n", want: FormatYAML},
+		{name: "unknown extension", path: "subst.txt", data: "KEY=value\n", want: FormatDotenv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectFormat(tt.path, []byte(tt.data)); got != tt.want {
+				t.Errorf("DetectFormat(%q) = %s, %s expected", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   map[interface{}]interface{}
+		err    bool
+	}{
+		{
+			name:   "yaml",
+			format: FormatYAML,
+			data:   "a:\n  b: 1\n",
+			want:   map[interface{}]interface{}{"a": map[interface{}]interface{}{"b": 1}},
+		},
+		{
+			name:   "json",
+			format: FormatJSON,
+			data:   `{"a": {"b": [1, "c"]}}`,
+			want:   map[interface{}]interface{}{"a": map[interface{}]interface{}{"b": []interface{}{1, "c"}}},
+		},
+		{
+			name:   "toml",
+			format: FormatTOML,
+			data:   "a = true\n[b]\nc = \"d\"\n",
+			want:   map[interface{}]interface{}{"a": true, "b": map[interface{}]interface{}{"c": "d"}},
+		},
+		{
+			name:   "dotenv",
+			format: FormatDotenv,
+			data:   "export A=1\nB=\"two words\"\n# comment\n",
+			want:   map[interface{}]interface{}{"A": "1", "B": "two words"},
+		},
+		{
+			name:   "properties",
+			format: FormatProperties,
+			data:   "app.name=subst\napp.port = 8080\nother: ${app.name}\n",
+			want: map[interface{}]interface{}{
+				"app":   map[interface{}]interface{}{"name": "subst", "port": "8080"},
+				"other": "${app.name}",
+			},
+		},
+		{name: "invalid toml", format: FormatTOML, data: "a = \n", err: true},
+		{name: "invalid dotenv", format: FormatDotenv, data: "not a variable\n", err: true},
+		{name: "properties value conflicting with nested", format: FormatProperties, data: "a=1\na.b=2\n", err: true},
+		{name: "invalid yaml", format: FormatYAML, data: "a: [\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFormat(tt.format, []byte(tt.data))
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseFormat() error = %v, error expected %t", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFormat() = %#v, %#v expected", got, tt.want)
+			}
+		})
+	}
+}
@@ -14,6 +14,16 @@ import (
 )
 
 func Template(data []byte, values map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+	rendered, err := Render(data, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseYAML(rendered)
+}
+
+// Render executes data as go template with the given values
+func Render(data []byte, values map[interface{}]interface{}) ([]byte, error) {
 	tmpl, err := template.New("f").Funcs(SprigFuncMap()).Parse(string(data))
 	if err != nil {
 		return nil, err
@@ -24,7 +34,7 @@ func Template(data []byte, values map[interface{}]interface{}) (map[interface{}]
 		return nil, err
 	}
 
-	return ParseYAML(buf.Bytes())
+	return buf.Bytes(), nil
 }
 
 // funcMap returns a mapping of all of the functions that Engine has.
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"reflect"
-	"regexp"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,9 +15,12 @@ import (
 
 type Configuration struct {
 	EnvRegex          string        `mapstructure:"env-regex"`
+	EnvParse          bool          `mapstructure:"env-parse"`
+	EnvLowercase      bool          `mapstructure:"env-lowercase"`
 	RootDirectory     string        `mapstructure:"root-dir"`
 	FileRegex         string        `mapstructure:"file-regex"`
-	SecretSkip        bool          `mapstructure:"secret-skip"`
+	SecretSkip        bool          `mapstructure:"skip-secret-lookup"`
+	SecretRequired    bool          `mapstructure:"secret-required"`
 	SecretName        string        `mapstructure:"secret-name"`
 	SecretNamespace   string        `mapstructure:"secret-namespace"`
 	EjsonKey          []string      `mapstructure:"ejson-key"`
@@ -26,10 +28,33 @@ type Configuration struct {
 	KubectlTimeout    time.Duration `mapstructure:"kubectl-timeout"`
 	Kubeconfig        string        `mapstructure:"kubeconfig"`
 	KubeAPI           string        `mapstructure:"kube-api"`
+	KubeTokenFile     string        `mapstructure:"kube-token-file"`
+	KubeCAFile        string        `mapstructure:"kube-ca-file"`
 	Output            string        `mapstructure:"output"`
 	ConvertSecretname bool          `mapstructure:"convert-secret-name"`
 	SopSKeyring       string        `mapstructure:"sops-keyring"`
 	SopsTempKeyring   bool          `mapstructure:"sops-temp-keyring"`
+	ClusterSelector   string        `mapstructure:"cluster-selector"`
+	ClusterNamespace  string        `mapstructure:"cluster-namespace"`
+	ClusterSecrets    bool          `mapstructure:"cluster-secrets"`
+	ClusterPrecedence string        `mapstructure:"cluster-precedence"`
+	SkipGit           bool          `mapstructure:"skip-git"`
+	GitStatus         bool          `mapstructure:"git-status"`
+	RemoteResources   bool          `mapstructure:"remote-resources"`
+	Recursive         bool          `mapstructure:"recursive"`
+	RecursiveDepth    int           `mapstructure:"recursive-depth"`
+	LoadRestrictor    string        `mapstructure:"load-restrictor"`
+	AlphaPlugins      bool          `mapstructure:"enable-alpha-plugins"`
+	EnableExec        bool          `mapstructure:"enable-exec"`
+	EnableHelm        bool          `mapstructure:"enable-helm"`
+	HelmCommand       string        `mapstructure:"helm-command"`
+	HelmChartHome     string        `mapstructure:"helm-chart-home"`
+	ManagedbyLabel    bool          `mapstructure:"enable-managedby-label"`
+	Reorder           string        `mapstructure:"reorder"`
+	EvalKustomization bool          `mapstructure:"eval-kustomization"`
+	CacheDir          string        `mapstructure:"cache-dir"`
+	Offline           bool          `mapstructure:"offline"`
+	RenderCache       bool          `mapstructure:"render-cache"`
 }
 
 func LoadConfiguration(cfgFile string, cmd *cobra.Command, directory string) (*Configuration, error) {
@@ -52,31 +77,37 @@ func LoadConfiguration(cfgFile string, cmd *cobra.Command, directory string) (*C
 	// Root Directory
 	cfg.RootDirectory = directory
 
+	if err := cfg.ResolveSecret(os.Getenv); err != nil {
+		return nil, err
+	}
+
+	if cfg.ClusterPrecedence != "" && cfg.ClusterPrecedence != "low" && cfg.ClusterPrecedence != "high" {
+		return nil, fmt.Errorf("cluster-precedence must be one of: low, high")
+	}
+
+	logrus.Debugf("Configuration: %+v\n", cfg)
+	return cfg, nil
+
+}
+
+// ResolveSecret derives the secret name and namespace from the ArgoCD application (if not set explicitly)
+func (cfg *Configuration) ResolveSecret(getenv func(string) string) error {
 	if cfg.SecretName == "" {
-		cfg.SecretName = os.Getenv("ARGOCD_APP_NAME")
+		cfg.SecretName = getenv("ARGOCD_APP_NAME")
 	}
 
 	if cfg.SecretName != "" {
-		if cfg.ConvertSecretname {
-			cfg.SecretName = getValueAfterUnderscore(cfg.SecretName)
-
-		} else {
-			regex := regexp.MustCompile(`[^a-zA-Z0-9]+`)
-			cfg.SecretName = regex.ReplaceAllString(cfg.SecretName, "-")
-		}
+		cfg.SecretName = SecretName(cfg.SecretName, cfg.ConvertSecretname)
 	}
 
 	if cfg.SecretNamespace == "" {
-		cfg.SecretNamespace = os.Getenv("ARGOCD_APP_NAMESPACE")
+		cfg.SecretNamespace = getenv("ARGOCD_APP_NAMESPACE")
 	}
 
 	if cfg.SecretName != "" && cfg.SecretNamespace == "" {
-		return nil, fmt.Errorf("secret-namespace must be set when --secret-name is set")
+		return fmt.Errorf("secret-namespace must be set when --secret-name is set")
 	}
-
-	logrus.Debugf("Configuration: %+v\n", cfg)
-	return cfg, nil
-
+	return nil
 }
 
 func PrintConfiguration(cfg *Configuration) {
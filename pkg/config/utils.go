@@ -2,8 +2,11 @@ package config
 
 import (
 	"regexp"
+	"strings"
 )
 
+var secretNameRegex = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
 func getValueAfterUnderscore(input string) string {
 	re, _ := regexp.Compile("_(.+)")
 
@@ -15,3 +18,21 @@ func getValueAfterUnderscore(input string) string {
 
 	return matches[1]
 }
+
+// SecretName returns the name of the secret with the decryption keys for the ArgoCD application name.
+// With convert only the application is used (without <project-name>_), otherwise special characters are replaced with dashes
+func SecretName(app string, convert bool) string {
+	if convert {
+		return getValueAfterUnderscore(app)
+	}
+	return secretNameRegex.ReplaceAllString(app, "-")
+}
+
+// SplitApplicationName splits an ArgoCD application name (<project-name>_<application-name>) into project and application
+func SplitApplicationName(input string) (project string, application string) {
+	application = getValueAfterUnderscore(input)
+	if application != input {
+		project = strings.TrimSuffix(input, "_"+application)
+	}
+	return project, application
+}
@@ -0,0 +1,110 @@
+package subst
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// TarFileSystem loads a tar archive (optionally gzip compressed) into an in-memory filesystem.
+// The files are placed relative to the root (/) of the filesystem
+func TarFileSystem(r io.Reader) (filesys.FileSystem, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	fSys := filesys.MakeFsInMemory()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := fSys.MkdirAll(archivePath(header.Name)); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+			}
+			if err := writeArchiveFile(fSys, header.Name, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fSys, nil
+}
+
+// ZipFileSystem loads a zip archive into an in-memory filesystem.
+// The files are placed relative to the root (/) of the filesystem
+func ZipFileSystem(r io.ReaderAt, size int64) (filesys.FileSystem, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zip archive: %w", err)
+	}
+
+	fSys := filesys.MakeFsInMemory()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			if err := fSys.MkdirAll(archivePath(f.Name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+		if err := writeArchiveFile(fSys, f.Name, buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return fSys, nil
+}
+
+// returns the path of an archive entry within the filesystem, entries can't escape the root
+func archivePath(name string) string {
+	return filepath.FromSlash(path.Clean("/" + name))
+}
+
+func writeArchiveFile(fSys filesys.FileSystem, name string, data []byte) error {
+	p := archivePath(name)
+	if err := fSys.MkdirAll(filepath.Dir(p)); err != nil {
+		return err
+	}
+	return fSys.WriteFile(p, data)
+}
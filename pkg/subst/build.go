@@ -1,8 +1,11 @@
 package subst
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"strings"
 
 	decrypt "github.com/buttahtoast/pkg/decryptors"
 	ejson "github.com/buttahtoast/pkg/decryptors/ejson"
@@ -12,7 +15,9 @@ import (
 	"github.com/buttahtoast/subst/pkg/config"
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
 )
 
 type Build struct {
@@ -21,130 +26,252 @@ type Build struct {
 	Substitutions *Substitutions
 	cfg           config.Configuration
 	kubeClient    *kubernetes.Clientset
+	fs            filesys.FileSystem
+	// Environment (KEY=value) used instead of the process environment
+	environ []string
+	// Initialized decryptors, used instead of creating them for each build
+	shared []decrypt.Decryptor
+	// Removes the temporary keyrings of the decryptors initialized by the build (see Close)
+	cleanups []func()
+	// Substitutions loaded from the cluster (loaded once per build)
+	cluster map[interface{}]interface{}
+	// Parsed substitution files shared with other builds (optional)
+	files *FileCache
+	// Encrypted resources were decrypted
+	decrypted bool
 }
 
 func New(config config.Configuration) (build *Build, err error) {
+	return NewWithFileSystem(config, filesys.MakeFsOnDisk())
+}
 
-	k, err := kustomize.NewKustomize(config.RootDirectory)
-	if err != nil {
-		return nil, err
+// NewWithFileSystem builds the kustomization within the given filesystem (eg. in memory or an archive)
+func NewWithFileSystem(config config.Configuration, fSys filesys.FileSystem) (build *Build, err error) {
+	return newBuild(context.Background(), &Build{cfg: config, fs: fSys})
+}
+
+// builds the kustomization of the prepared build (configuration, filesystem etc.)
+func newBuild(ctx context.Context, init *Build) (build *Build, err error) {
+	config, fSys := init.cfg, init.fs
+
+	cacheDir := config.CacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultCacheDir()
+	}
+
+	opts := kustomize.Options{
+		RemoteResources: config.RemoteResources,
+		CacheDir:        cacheDir,
+		Offline:         config.Offline,
+		Recursive:       config.Recursive,
+		MaxDepth:        config.RecursiveDepth,
+
+		LoadRestrictor:     config.LoadRestrictor,
+		EnableAlphaPlugins: config.AlphaPlugins,
+		EnableExec:         config.EnableExec,
+		EnableHelm:         config.EnableHelm,
+		HelmCommand:        config.HelmCommand,
+		HelmChartHome:      config.HelmChartHome,
+		AddManagedbyLabel:  config.ManagedbyLabel,
+		Reorder:            config.Reorder,
+		FileSystem:         fSys,
 	}
 
-	init := &Build{
-		cfg:           config,
-		Kustomization: k,
+	if config.EvalKustomization {
+		// The substitution files of the pre-build paths are loaded again after the build
+		if init.files == nil {
+			init.files = NewFileCache()
+		}
+		opts.Preprocess, err = init.kustomizationEvaluator(ctx, opts)
+		if err != nil {
+			init.Close()
+			return nil, err
+		}
+	}
+
+	init.Kustomization, err = kustomize.NewKustomize(config.RootDirectory, opts)
+	if err != nil {
+		init.Close()
+		return nil, &KustomizeError{Path: config.RootDirectory, Err: err}
 	}
 
 	return init, err
 }
 
 func (b *Build) BuildSubstitutions() (err error) {
-	decryptors, cleanups, err := b.decryptors()
+	return b.BuildSubstitutionsContext(context.Background())
+}
+
+// BuildSubstitutionsContext loads the substitutions, the context is used for requests to the cluster
+func (b *Build) BuildSubstitutionsContext(ctx context.Context) (err error) {
+	b.Substitutions, err = b.substitutions(ctx, b.Kustomization, b.Kustomization.Build)
+	return err
+}
+
+// loads the substitutions of the kustomization paths
+func (b *Build) substitutions(ctx context.Context, k *kustomize.Kustomize, res resmap.ResMap) (s *Substitutions, err error) {
+	decryptors, err := b.initDecryptors(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer func() {
-		for _, cleanup := range cleanups {
-			cleanup()
-		}
-	}()
-
 	SubstitutionsConfig := SubstitutionsConfig{
 		EnvironmentRegex: b.cfg.EnvRegex,
+		EnvironmentParse: b.cfg.EnvParse,
 		SubstFileRegex:   b.cfg.FileRegex,
+		FlattenLowerCase: b.cfg.EnvLowercase,
+		CacheDir:         b.cfg.CacheDir,
+		Offline:          b.cfg.Offline,
+		FileSystem:       b.fs,
+		Environment:      b.environ,
+		Files:            b.files,
 	}
 
-	b.Substitutions, err = NewSubstitutions(SubstitutionsConfig, decryptors, b.Kustomization.Build)
+	s, err = NewSubstitutions(SubstitutionsConfig, decryptors, res)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = b.loadSubstitutions()
+	err = s.Add(b.builtins(), true)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+
+	err = b.loadSubstitutions(ctx, s, k)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 
 }
 
 func (b *Build) Build() (err error) {
+	return b.BuildContext(context.Background())
+}
+
+// BuildContext substitutes the manifests, the build is aborted when the context is done
+func (b *Build) BuildContext(ctx context.Context) (err error) {
 
 	if b.Substitutions == nil {
 		logrus.Debug("no resources to build")
 		return nil
 	}
 
-	decryptors, cleanups, err := b.decryptors()
+	decryptors, err := b.initDecryptors(ctx)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		for _, cleanup := range cleanups {
-			cleanup()
-		}
-	}()
-
 	// Run Build
 	logrus.Debug("substitute manifests")
 	for _, manifest := range b.Substitutions.Resources.Resources() {
-		var c map[interface{}]interface{}
-
-		mBytes, _ := manifest.MarshalJSON()
-		for _, d := range decryptors {
-			isEncrypted, err := d.IsEncrypted(mBytes)
-			if err != nil {
-				logrus.Errorf("Error checking encryption for %s: %s", mBytes, err)
-				continue
-			}
-			if isEncrypted {
-				dm, err := d.Decrypt(mBytes)
-				if err != nil {
-					return fmt.Errorf("failed to decrypt %s: %s", mBytes, err)
-				}
-				c = utils.ToInterface(dm)
-				break
-			}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := b.substitute(manifest, decryptors)
+		if err != nil {
+			return err
 		}
+		b.Manifests = append(b.Manifests, m)
+	}
+
+	return nil
+}
 
-		if c == nil {
-			m, _ := manifest.AsYAML()
+// decrypts and substitutes the resource
+func (b *Build) substitute(manifest *resource.Resource, decryptors []decrypt.Decryptor) (map[interface{}]interface{}, error) {
+	var c map[interface{}]interface{}
 
-			c, err = utils.ParseYAML(m)
+	mBytes, _ := manifest.MarshalJSON()
+	for _, d := range decryptors {
+		isEncrypted, err := d.IsEncrypted(mBytes)
+		if err != nil {
+			logrus.Errorf("Error checking encryption for %s: %s", mBytes, err)
+			continue
+		}
+		if isEncrypted {
+			dm, err := d.Decrypt(mBytes)
 			if err != nil {
-				return fmt.Errorf("UnmarshalJSON: %w", err)
+				return nil, &DecryptError{Resource: manifest.CurId().String(), Err: err}
 			}
+			b.decrypted = true
+			c = utils.ToInterface(dm)
+			break
 		}
+	}
+
+	if c == nil {
+		m, _ := manifest.AsYAML()
 
-		f, err := b.Substitutions.Eval(c, nil, false)
+		var err error
+		c, err = utils.ParseYAML(m)
 		if err != nil {
-			return fmt.Errorf("spruce evaluation failed %s/%s: %s", manifest.GetNamespace(), manifest.GetName(), err)
+			return nil, fmt.Errorf("UnmarshalJSON: %w", err)
+		}
+
+		// Without operators the evaluation only prunes the substitutions key
+		if !bytes.Contains(m, []byte("((")) {
+			delete(c, b.Substitutions.Config.SubstKey)
+			return c, nil
 		}
-		b.Manifests = append(b.Manifests, f)
 	}
 
-	return nil
+	f, err := b.Substitutions.Eval(c, nil, false)
+	if err != nil {
+		return nil, evalError("", manifest.CurId().String(), c, err)
+	}
+	return f, nil
 }
 
 // builds the substitutions interface
-func (b *Build) loadSubstitutions() (err error) {
+func (b *Build) loadSubstitutions(ctx context.Context, s *Substitutions, k *kustomize.Kustomize) (err error) {
+
+	var cluster map[interface{}]interface{}
+	if b.cfg.ClusterSelector != "" {
+		if b.cluster == nil {
+			if b.cluster, err = b.clusterSubstitutions(ctx); err != nil {
+				return err
+			}
+			if err := checkReserved(b.cluster, "cluster substitutions"); err != nil {
+				return err
+			}
+		}
+		// The substitutions modify the added data
+		cluster = copyTree(b.cluster).(map[interface{}]interface{})
+	}
+
+	if b.cfg.ClusterPrecedence != ClusterPrecedenceHigh && cluster != nil {
+		if err = s.Add(cluster, true); err != nil {
+			return err
+		}
+	}
 
 	// Read Substition Files
-	err = b.Kustomization.Walk(b.Substitutions.Walk)
+	err = k.Walk(s.Walk)
 	if err != nil {
 		return err
 	}
 
+	if b.cfg.ClusterPrecedence == ClusterPrecedenceHigh && cluster != nil {
+		if err = s.Add(cluster, true); err != nil {
+			return err
+		}
+	}
+
+	// Parameters of the application have the highest precedence
+	if err = s.addParameters(b.getenv); err != nil {
+		return err
+	}
+
 	// Final attempt to evaluate
-	eval, err := b.Substitutions.Eval(b.Substitutions.Subst, nil, false)
+	eval, err := s.Eval(s.Subst, nil, false)
 	if err != nil {
-		return fmt.Errorf("spruce evaluation failed")
+		return evalError("", "", s.Subst, err)
 	}
-	b.Substitutions.Subst = eval
+	s.Subst = eval
 
-	if len(b.Substitutions.Subst) > 0 {
-		logrus.Debug("loaded substitutions: ", b.Substitutions.Subst)
+	if len(s.Subst) > 0 {
+		logrus.Debug("loaded substitutions: ", s.Subst)
 	} else {
 		logrus.Debug("no substitutions found")
 	}
@@ -152,8 +279,36 @@ func (b *Build) loadSubstitutions() (err error) {
 	return nil
 }
 
+// returns the decryptors of the build, they are initialized once (eg. for the evaluation of the kustomization
+// and the build) unless they are shared
+func (b *Build) initDecryptors(ctx context.Context) ([]decrypt.Decryptor, error) {
+	if b.shared != nil {
+		return b.shared, nil
+	}
+	decryptors, cleanups, err := b.decryptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.shared, b.cleanups = decryptors, cleanups
+	return decryptors, nil
+}
+
+// Close removes the temporary keyrings of the decryptors initialized by the build
+func (b *Build) Close() {
+	if b.cleanups == nil {
+		return
+	}
+	for _, cleanup := range b.cleanups {
+		cleanup()
+	}
+	b.shared, b.cleanups = nil, nil
+}
+
 // initialize decryption
-func (b *Build) decryptors() (decryptors []decrypt.Decryptor, cleanups []func(), err error) {
+func (b *Build) decryptors(ctx context.Context) (decryptors []decrypt.Decryptor, cleanups []func(), err error) {
+	if b.shared != nil {
+		return b.shared, nil, nil
+	}
 
 	c := decrypt.DecryptorConfig{
 		SkipDecrypt: b.cfg.SkipDecrypt,
@@ -176,33 +331,73 @@ func (b *Build) decryptors() (decryptors []decrypt.Decryptor, cleanups []func(),
 		decryptors = append(decryptors, sops.NewSOPSDecryptor(c, b.cfg.SopSKeyring))
 	}
 
-	if b.cfg.SecretSkip {
+	if b.cfg.SkipDecrypt {
 		return
 	}
 
-	if !b.cfg.SkipDecrypt && (b.cfg.SecretName != "" && b.cfg.SecretNamespace != "") {
-
-		var host string
-		if b.cfg.KubeAPI != "" {
-			host = b.cfg.KubeAPI
+	var serr error
+	switch {
+	case b.cfg.SecretRequired && b.cfg.SecretSkip:
+		serr = &SecretError{Name: b.cfg.SecretName, Namespace: b.cfg.SecretNamespace, Err: fmt.Errorf("the lookup is skipped (--skip-secret-lookup)")}
+	case b.cfg.SecretSkip:
+		return
+	case b.cfg.SecretName == "" || b.cfg.SecretNamespace == "":
+		if b.cfg.SecretRequired {
+			serr = &SecretError{Name: b.cfg.SecretName, Namespace: b.cfg.SecretNamespace, Err: fmt.Errorf("no secret name (set --secret-name or ARGOCD_APP_NAME)")}
 		}
-		cfg, err := clientcmd.BuildConfigFromFlags(host, b.cfg.Kubeconfig)
-		if err == nil {
-			b.kubeClient, err = kubernetes.NewForConfig(cfg)
-			if err != nil {
-				logrus.Debug("could not load kubernetes client: %s", err)
-			} else {
-				ctx := context.Background()
-				for _, decr := range decryptors {
-					err = decr.KeysFromSecret(b.cfg.SecretName, b.cfg.SecretNamespace, b.kubeClient, ctx)
-					if err != nil {
-						logrus.Debug("failed to load secrets from Kubernetes: %s", err)
-					}
-				}
-
-			}
+	default:
+		serr = b.keysFromSecret(ctx, decryptors)
+	}
+	if serr == nil {
+		return
+	}
+	if b.cfg.SecretRequired {
+		for _, cleanup := range cleanups {
+			cleanup()
 		}
+		return nil, nil, serr
 	}
+	// The error names the secret and its namespace
+	logrus.Warnf("continuing without decryption keys: %s", serr)
 
 	return
 }
+
+// returns the environment variable (from the build environment if set)
+func (b *Build) getenv(key string) string {
+	if b.environ == nil {
+		return os.Getenv(key)
+	}
+	prefix := key + "="
+	for _, e := range b.environ {
+		if strings.HasPrefix(e, prefix) {
+			return strings.TrimPrefix(e, prefix)
+		}
+	}
+	return ""
+}
+
+// returns the context for requests to the cluster (limited by the kubectl timeout)
+func (b *Build) kubeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.cfg.KubectlTimeout > 0 {
+		return context.WithTimeout(ctx, b.cfg.KubectlTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// returns the kubernetes client, initializes it on first use
+func (b *Build) kubernetesClient() (*kubernetes.Clientset, error) {
+	if b.kubeClient != nil {
+		return b.kubeClient, nil
+	}
+
+	cfg, err := restConfig(b.cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.kubeClient, err = kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return b.kubeClient, nil
+}
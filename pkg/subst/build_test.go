@@ -0,0 +1,118 @@
+package subst
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buttahtoast/subst/pkg/config"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// returns a filesystem with a kustomization of n ConfigMaps, every nth with a spruce operator (0 for none)
+func benchmarkFileSystem(b *testing.B, n int, operators int) filesys.FileSystem {
+	fSys := filesys.MakeFsInMemory()
+	var res strings.Builder
+	for i := 0; i < n; i++ {
+		value := "static"
+		if operators > 0 && i%operators == 0 {
+			value = "(( grab subst.value ))"
+		}
+		fmt.Fprintf(&res, "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm-%d\ndata:\n  key: %q\n  other: value-%d\n", i, value, i)
+	}
+	files := map[string]string{
+		"/app/kustomization.yaml": "resources:\n- resources.yaml\n",
+		"/app/resources.yaml":     res.String(),
+		"/app/subst.yaml":         "value: substituted\n",
+	}
+	for name, content := range files {
+		if err := fSys.WriteFile(name, []byte(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return fSys
+}
+
+// BenchmarkBuild measures the substitution of the resources (kustomize build and substitution files excluded).
+// Resources without operators skip the spruce evaluation
+func BenchmarkBuild(b *testing.B) {
+	for _, bc := range []struct {
+		name      string
+		operators int
+	}{
+		{"all-operators", 1},
+		{"half-operators", 2},
+		{"no-operators", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := DefaultConfiguration()
+			cfg.RootDirectory = "/app"
+			cfg.SecretSkip = true
+			cfg.SkipGit = true
+			cfg.SopsTempKeyring = false
+			cfg.EnableHelm = false
+
+			build, err := NewWithFileSystem(cfg, benchmarkFileSystem(b, 2000, bc.operators))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := build.BuildSubstitutions(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				build.Manifests = nil
+				if err := build.BuildContext(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptorsSecret(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "kubeconfig")
+	lookup := func(cfg *config.Configuration) {
+		cfg.SecretName, cfg.SecretNamespace, cfg.Kubeconfig = "app", "argocd", missing
+	}
+	tests := []struct {
+		name     string
+		cfg      func(cfg *config.Configuration)
+		required bool
+		// SecretError expected
+		err bool
+	}{
+		{name: "skipped", cfg: func(cfg *config.Configuration) { cfg.SecretSkip = true }},
+		{name: "skipped required", cfg: func(cfg *config.Configuration) { cfg.SecretSkip = true }, required: true, err: true},
+		{name: "no secret name", cfg: func(cfg *config.Configuration) {}},
+		{name: "no secret name required", cfg: func(cfg *config.Configuration) {}, required: true, err: true},
+		{name: "lookup failed", cfg: lookup},
+		{name: "lookup failed required", cfg: lookup, required: true, err: true},
+		{name: "decryption skipped required", cfg: func(cfg *config.Configuration) { cfg.SkipDecrypt = true }, required: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfiguration()
+			cfg.SopsTempKeyring = false
+			cfg.SecretRequired = tt.required
+			tt.cfg(&cfg)
+
+			b := &Build{cfg: cfg}
+			_, cleanups, err := b.decryptors(context.Background())
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+			var secretErr *SecretError
+			if got := errors.As(err, &secretErr); got != tt.err {
+				t.Fatalf("decryptors() = %v, SecretError expected %t", err, tt.err)
+			}
+			if tt.err && (secretErr.Name != cfg.SecretName || secretErr.Namespace != cfg.SecretNamespace) {
+				t.Errorf("SecretError names %s/%s, %s/%s expected", secretErr.Namespace, secretErr.Name, cfg.SecretNamespace, cfg.SecretName)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package subst
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/buttahtoast/subst/internal/git"
+	"github.com/buttahtoast/subst/internal/kustomize"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Reserved substitution key for ArgoCD application metadata
+	argocdField = "argocd"
+	// Reserved substitution key for git metadata
+	gitField = "git"
+)
+
+// ArgoCD build environment variables exposed as substitutions (independent of the environment regex)
+// https://argo-cd.readthedocs.io/en/stable/user-guide/build-environment/
+var argocdVariables = map[string]string{
+	"ARGOCD_APP_NAME":                   "app",
+	"ARGOCD_APP_NAMESPACE":              "namespace",
+	"ARGOCD_APP_REVISION":               "revision",
+	"ARGOCD_APP_REVISION_SHORT":         "revisionShort",
+	"ARGOCD_APP_SOURCE_PATH":            "sourcePath",
+	"ARGOCD_APP_SOURCE_REPO_URL":        "sourceRepoURL",
+	"ARGOCD_APP_SOURCE_TARGET_REVISION": "sourceTargetRevision",
+	"ARGOCD_APP_PROJECT_NAME":           "project",
+	"KUBE_VERSION":                      "kubeVersion",
+	"KUBE_API_VERSIONS":                 "kubeApiVersions",
+}
+
+// returns the built-in substitutions
+func (b *Build) builtins() map[interface{}]interface{} {
+	builtins := make(map[interface{}]interface{})
+
+	if argocd := argocdBuiltins(b.getenv); len(argocd) > 0 {
+		builtins[argocdField] = argocd
+	}
+
+	// Git metadata is only read from disk
+	if !b.cfg.SkipGit && kustomize.OnDisk(b.fs) {
+		if g := gitBuiltins(b.cfg.RootDirectory, b.getenv, b.cfg.GitStatus); len(g) > 0 {
+			builtins[gitField] = g
+		}
+	}
+
+	return builtins
+}
+
+// rejects substitutions which define the keys of the built-in substitutions (they would silently replace them)
+func checkReserved(data map[interface{}]interface{}, source string) error {
+	for _, key := range []string{argocdField, gitField} {
+		if _, ok := data[key]; ok {
+			return fmt.Errorf("%s: the key %q is reserved for built-in substitutions", source, key)
+		}
+	}
+	return nil
+}
+
+// returns the ArgoCD application metadata, the project is derived from the application name if not set explicitly
+func argocdBuiltins(getenv func(string) string) map[interface{}]interface{} {
+	argocd := make(map[interface{}]interface{})
+	for env, key := range argocdVariables {
+		if value := getenv(env); value != "" {
+			argocd[key] = value
+		}
+	}
+
+	if app, ok := argocd["app"].(string); ok {
+		project, name := config.SplitApplicationName(app)
+		argocd["name"] = name
+		if _, ok := argocd["project"]; !ok && project != "" {
+			argocd["project"] = project
+		}
+	}
+	return argocd
+}
+
+// returns the git metadata of the repository containing the directory, the changes of the work tree only with status.
+// Without repository (eg. ArgoCD CMP) the commit is taken from the ArgoCD revision
+func gitBuiltins(dir string, getenv func(string) string, status bool) map[interface{}]interface{} {
+	meta := make(map[interface{}]interface{})
+
+	repo, err := git.Open(dir)
+	if err != nil {
+		if !errors.Is(err, git.ErrNotRepository) {
+			logrus.Warnf("failed to read git repository: %s", err)
+		}
+		if revision := getenv("ARGOCD_APP_REVISION"); revision != "" {
+			meta["commit"] = revision
+			meta["commitShort"] = shortCommit(revision)
+		}
+		return meta
+	}
+
+	branch, hash, err := repo.Head()
+	if err != nil {
+		logrus.Warnf("failed to read git HEAD: %s", err)
+		return meta
+	}
+	meta["commit"] = hash
+	meta["commitShort"] = shortCommit(hash)
+	if branch != "" {
+		meta["branch"] = branch
+	}
+
+	if commit, err := repo.Commit(hash); err != nil {
+		logrus.Warnf("failed to read git commit %s: %s", hash, err)
+	} else {
+		meta["timestamp"] = commit.Time.Format(time.RFC3339)
+	}
+
+	if tag, err := repo.NearestTag(hash); err != nil {
+		logrus.Warnf("failed to resolve git tag: %s", err)
+	} else if tag != "" {
+		meta["tag"] = tag
+	}
+
+	if !status {
+		return meta
+	}
+	if changes, err := repo.Changes(); err != nil {
+		logrus.Warnf("failed to read git status: %s", err)
+	} else {
+		files := make([]interface{}, 0, len(changes))
+		for _, c := range changes {
+			files = append(files, c)
+		}
+		meta["dirty"] = len(changes) > 0
+		meta["changedFiles"] = files
+	}
+
+	return meta
+}
+
+func shortCommit(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
@@ -0,0 +1,55 @@
+package subst
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestReservedBuiltins(t *testing.T) {
+	tests := []struct {
+		name  string
+		subst string
+		err   bool
+	}{
+		{name: "no reserved keys", subst: "value: a\napp: (( grab subst.argocd.app ))\n"},
+		{name: "argocd", subst: "argocd:\n  app: other\n", err: true},
+		{name: "git", subst: "git:\n  commit: other\n", err: true},
+		{name: "nested", subst: "values:\n  git: a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fSys := filesys.MakeFsInMemory()
+			for name, content := range map[string]string{
+				"/app/kustomization.yaml": "resources: []\n",
+				"/app/subst.yaml":         tt.subst,
+			} {
+				if err := fSys.WriteFile(name, []byte(content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := DefaultConfiguration()
+			cfg.RootDirectory = "/app"
+			cfg.SecretSkip = true
+			cfg.SopsTempKeyring = false
+			cfg.EnableHelm = false
+
+			build, err := NewWithFileSystem(cfg, fSys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			build.environ = []string{"ARGOCD_APP_NAME=app"}
+			err = build.BuildSubstitutions()
+			if (err != nil) != tt.err {
+				t.Fatalf("BuildSubstitutions() error = %v, error expected %t", err, tt.err)
+			}
+			if tt.err && !strings.Contains(err.Error(), "reserved") {
+				t.Fatalf("BuildSubstitutions() error = %v, reserved key expected", err)
+			}
+			if !tt.err && build.Substitutions.Subst[argocdField].(map[interface{}]interface{})["app"] != "app" {
+				t.Errorf("argocd builtins replaced: %v", build.Substitutions.Subst[argocdField])
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/buttahtoast/subst/internal/git"
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Changes of the format invalidate all entries
+	renderCacheVersion = "v1"
+	// Entries which were not used within this period are removed
+	renderCacheMaxAge = 7 * 24 * time.Hour
+)
+
+var (
+	// Prefixes of the stored entries
+	renderCachePlain     = []byte("plain\n")
+	renderCacheEncrypted = []byte("aesgcm\n")
+)
+
+// RenderCache stores rendered output on disk. Entries are addressed by the hash of the configuration, the relevant
+// environment variables and the content of all directories the build depends on.
+// Output with decrypted material is only stored encrypted, which requires a key
+type RenderCache struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+// the directories of the last render of a configuration (the content of the entry is addressed by their hash)
+type renderCacheIndex struct {
+	Dirs []string `json:"dirs"`
+}
+
+// NewRenderCache returns the cache within dir. With key all entries are encrypted (AES-GCM with the SHA-256 of the key)
+func NewRenderCache(dir string, key string) (*RenderCache, error) {
+	c := &RenderCache{dir: filepath.Join(dir, "render")}
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return nil, err
+		}
+		if c.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get returns the cached output of the configuration (environ is used instead of the process environment if not nil)
+func (c *RenderCache) Get(cfg config.Configuration, environ []string) ([]byte, bool) {
+	index, err := c.index(cfg, environ)
+	if err != nil {
+		logrus.Debugf("render cache disabled: %s", err)
+		return nil, false
+	}
+
+	var idx renderCacheIndex
+	indexPath := c.path("index", index)
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, false
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, false
+	}
+	key, err := c.key(index, idx.Dirs)
+	if err != nil {
+		return nil, false
+	}
+
+	path := c.path("objects", key)
+	data, err = os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	out, err := c.decode(data)
+	if err != nil {
+		logrus.Debugf("ignoring render cache entry %s: %s", key, err)
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	_ = os.Chtimes(indexPath, now, now)
+	logrus.Debugf("render cache hit %s", key)
+	return out, true
+}
+
+// Put stores the output of the build. Builds which depend on the cluster or remote sources are not stored,
+// builds with decrypted material only if the cache has a key
+func (c *RenderCache) Put(b *Build, out []byte) error {
+	switch {
+	case b.Kustomization.Remote():
+		logrus.Debug("not caching render with remote resources")
+		return nil
+	case b.Substitutions != nil && b.Substitutions.remote:
+		logrus.Debug("not caching render with remote sources")
+		return nil
+	case c.aead == nil && (b.decrypted || (b.Substitutions != nil && b.Substitutions.decrypted)):
+		logrus.Debug("not caching render with decrypted material (no cache key)")
+		return nil
+	}
+
+	index, err := c.index(b.cfg, b.environ)
+	if err != nil {
+		logrus.Debugf("render cache disabled: %s", err)
+		return nil
+	}
+	dirs := b.Kustomization.Dirs()
+	for i, dir := range dirs {
+		if dirs[i], err = filepath.Abs(dir); err != nil {
+			return err
+		}
+	}
+	key, err := c.key(index, dirs)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.encode(out)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(c.path("objects", key), data); err != nil {
+		return err
+	}
+	idx, err := json.Marshal(renderCacheIndex{Dirs: dirs})
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(c.path("index", index), idx); err != nil {
+		return err
+	}
+	logrus.Debugf("stored render cache entry %s", key)
+
+	c.prune()
+	return nil
+}
+
+// returns the hash of the configuration, the relevant environment variables, the version of the secret, the git commit
+// and the changed files
+func (c *RenderCache) index(cfg config.Configuration, environ []string) (string, error) {
+	if cfg.ClusterSelector != "" {
+		return "", fmt.Errorf("substitutions are loaded from the cluster")
+	}
+	if environ == nil {
+		environ = os.Environ()
+	}
+	root, err := filepath.Abs(cfg.RootDirectory)
+	if err != nil {
+		return "", err
+	}
+	cfg.RootDirectory = root
+	cfg.RenderCache = false
+
+	envs, err := getVariables(cfg.EnvRegex, environ)
+	if err != nil {
+		return "", err
+	}
+	b := &Build{cfg: cfg, environ: environ}
+	for env := range argocdVariables {
+		if value := b.getenv(env); value != "" {
+			envs[env] = value
+		}
+	}
+	if value := b.getenv(parametersVariable); value != "" {
+		envs[parametersVariable] = value
+	}
+
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	if err := enc.Encode(renderCacheVersion); err != nil {
+		return "", err
+	}
+	if err := enc.Encode(cfg); err != nil {
+		return "", err
+	}
+	// Maps are encoded with sorted keys
+	if err := enc.Encode(envs); err != nil {
+		return "", err
+	}
+	// A hit skips the secret lookup, the entry must not outlive the keys it was decrypted with
+	secret, err := b.secretVersion(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("failed to read the secret: %w", err)
+	}
+	if err := enc.Encode(secret); err != nil {
+		return "", err
+	}
+
+	if !cfg.SkipGit {
+		if repo, err := git.Open(root); err == nil {
+			_, commit, err := repo.Head()
+			if err != nil {
+				return "", err
+			}
+			_, _ = io.WriteString(h, commit)
+			// The git builtins (dirty, changedFiles) depend on the work tree as well
+			if cfg.GitStatus {
+				changes, err := repo.Changes()
+				if err != nil {
+					return "", err
+				}
+				for _, path := range changes {
+					fmt.Fprintf(h, "changed %s\n", path)
+				}
+			}
+		} else if !errors.Is(err, git.ErrNotRepository) {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// returns the hash of the index and the files within the directories
+func (c *RenderCache) key(index string, dirs []string) (string, error) {
+	h := sha256.New()
+	_, _ = io.WriteString(h, index)
+
+	sorted := append([]string(nil), dirs...)
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		if err := hashDir(h, dir); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writes the names and content of the files within the directory (without subdirectories) to the hash
+func hashDir(h io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "dir %s\n", dir)
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "file %s %x\n", entry.Name(), sum)
+	}
+	return nil
+}
+
+// encrypts the output if the cache has a key
+func (c *RenderCache) encode(out []byte) ([]byte, error) {
+	if c.aead == nil {
+		return append(append([]byte(nil), renderCachePlain...), out...), nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data := append(append([]byte(nil), renderCacheEncrypted...), nonce...)
+	return c.aead.Seal(data, nonce, out, renderCacheEncrypted), nil
+}
+
+// decrypts the entry, encrypted entries require the key
+func (c *RenderCache) decode(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, renderCachePlain):
+		return data[len(renderCachePlain):], nil
+	case bytes.HasPrefix(data, renderCacheEncrypted):
+		if c.aead == nil {
+			return nil, fmt.Errorf("entry is encrypted")
+		}
+		data = data[len(renderCacheEncrypted):]
+		if len(data) < c.aead.NonceSize() {
+			return nil, fmt.Errorf("entry is truncated")
+		}
+		nonce, sealed := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+		return c.aead.Open(nil, nonce, sealed, renderCacheEncrypted)
+	}
+	return nil, fmt.Errorf("unknown entry format")
+}
+
+func (c *RenderCache) path(kind string, key string) string {
+	return filepath.Join(c.dir, kind, key)
+}
+
+// removes entries which were not used within the maximum age
+func (c *RenderCache) prune() {
+	for _, kind := range []string{"index", "objects"} {
+		entries, err := os.ReadDir(filepath.Join(c.dir, kind))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < renderCacheMaxAge {
+				continue
+			}
+			_ = os.Remove(c.path(kind, entry.Name()))
+		}
+	}
+}
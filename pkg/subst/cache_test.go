@@ -0,0 +1,197 @@
+package subst
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buttahtoast/subst/pkg/config"
+)
+
+func TestRenderCacheEncode(t *testing.T) {
+	out := []byte("apiVersion: v1\nkind: Secret\n")
+	plain, err := NewRenderCache(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := NewRenderCache(t.TempDir(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRenderCache(t.TempDir(), "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainData, err := plain.encode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedData, err := encrypted.encode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encryptedData, out) {
+		t.Fatal("encrypted entry contains the output")
+	}
+	tampered := append([]byte(nil), encryptedData...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	for _, tc := range []struct {
+		name    string
+		cache   *RenderCache
+		data    []byte
+		wantErr bool
+	}{
+		{"plain", plain, plainData, false},
+		{"plain with key", encrypted, plainData, false},
+		{"encrypted", encrypted, encryptedData, false},
+		{"encrypted without key", plain, encryptedData, true},
+		{"encrypted with other key", other, encryptedData, true},
+		{"tampered", encrypted, tampered, true},
+		{"truncated", encrypted, renderCacheEncrypted, true},
+		{"unknown format", encrypted, out, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.cache.decode(tc.data)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, out) {
+				t.Fatalf("got %q, want %q", got, out)
+			}
+		})
+	}
+}
+
+func TestRenderCacheDecrypted(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "kustomization.yaml"), []byte("resources: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfiguration()
+	cfg.RootDirectory = root
+	cfg.SkipGit = true
+	cfg.EnableHelm = false
+
+	out := []byte("decrypted\n")
+	for _, tc := range []struct {
+		name   string
+		key    string
+		stored bool
+	}{
+		{"without key", "", false},
+		{"with key", "key", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cache, err := NewRenderCache(dir, tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			build, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			build.environ = []string{}
+			build.decrypted = true
+
+			if err := cache.Put(build, out); err != nil {
+				t.Fatal(err)
+			}
+			objects, _ := os.ReadDir(filepath.Join(dir, "render", "objects"))
+			if stored := len(objects) > 0; stored != tc.stored {
+				t.Fatalf("stored %t, want %t", stored, tc.stored)
+			}
+			got, ok := cache.Get(cfg, build.environ)
+			if ok != tc.stored {
+				t.Fatalf("cache hit %t, want %t", ok, tc.stored)
+			}
+			if ok && !bytes.Equal(got, out) {
+				t.Fatalf("got %q, want %q", got, out)
+			}
+		})
+	}
+}
+
+func TestRenderCacheKey(t *testing.T) {
+	files := map[string]string{
+		"app/kustomization.yaml": "resources: []\nconfigurations:\n- ../conf/config.yaml\n",
+		"conf/config.yaml":       "commonLabels:\n- path: metadata/labels\n  create: true\n",
+	}
+	for _, tc := range []struct {
+		name string
+		cfg  func(cfg *config.Configuration)
+		// Modification after the entry was stored
+		change func(t *testing.T, dir string)
+		hit    bool
+	}{
+		{name: "unchanged", change: func(t *testing.T, dir string) {}, hit: true},
+		{
+			name: "configuration changed",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, dir, "conf/config.yaml", strings.Replace(files["conf/config.yaml"], "true", "false", 1))
+			},
+		},
+		{
+			name: "secret not readable",
+			cfg: func(cfg *config.Configuration) {
+				cfg.SecretName, cfg.SecretNamespace, cfg.Kubeconfig = "app", "argocd", filepath.Join(t.TempDir(), "kubeconfig")
+			},
+			change: func(t *testing.T, dir string) {},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range files {
+				writeTestFile(t, dir, name, content)
+			}
+			cfg := DefaultConfiguration()
+			cfg.RootDirectory = filepath.Join(dir, "app")
+			cfg.SkipGit = true
+			cfg.EnableHelm = false
+			cfg.SecretSkip = true
+			if tc.cfg != nil {
+				cfg.SecretSkip = false
+				tc.cfg(&cfg)
+			}
+
+			cache, err := NewRenderCache(t.TempDir(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			build, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			build.environ = []string{}
+			if err := cache.Put(build, []byte("out\n")); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.change(t, dir)
+			if _, ok := cache.Get(cfg, build.environ); ok != tc.hit {
+				t.Fatalf("cache hit %t, want %t", ok, tc.hit)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package subst
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/geofffranks/spruce"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Precedence of substitutions loaded from the cluster
+const (
+	// Cluster substitutions are loaded before the substitution files (files overwrite cluster values)
+	ClusterPrecedenceLow = "low"
+	// Cluster substitutions are loaded after the substitution files (cluster values overwrite files)
+	ClusterPrecedenceHigh = "high"
+)
+
+// returns the substitutions from labeled ConfigMaps (and optionally Secrets) within the namespace
+func (b *Build) clusterSubstitutions(ctx context.Context) (map[interface{}]interface{}, error) {
+	namespace := b.cfg.ClusterNamespace
+	if namespace == "" {
+		namespace = b.cfg.SecretNamespace
+	}
+	if namespace == "" {
+		return nil, fmt.Errorf("namespace required to load substitutions from cluster (set --cluster-namespace)")
+	}
+
+	client, err := b.kubernetesClient()
+	if err != nil {
+		return nil, fmt.Errorf("could not load kubernetes client: %w", err)
+	}
+
+	ctx, cancel := b.kubeContext(ctx)
+	defer cancel()
+
+	opts := metav1.ListOptions{LabelSelector: b.cfg.ClusterSelector}
+	var sources []clusterSource
+
+	cms, err := client.CoreV1().ConfigMaps(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list configmaps in %s: %w", namespace, err)
+	}
+	for _, cm := range cms.Items {
+		data := make(map[string][]byte, len(cm.Data))
+		for k, v := range cm.Data {
+			data[k] = []byte(v)
+		}
+		sources = append(sources, clusterSource{ref: "configmap/" + namespace + "/" + cm.Name, name: cm.Name, data: data})
+	}
+
+	if b.cfg.ClusterSecrets {
+		secrets, err := client.CoreV1().Secrets(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list secrets in %s: %w", namespace, err)
+		}
+		for _, secret := range secrets.Items {
+			sources = append(sources, clusterSource{ref: "secret/" + namespace + "/" + secret.Name, name: secret.Name, data: secret.Data})
+		}
+	}
+
+	// Deterministic order, Secrets overwrite ConfigMaps with the same name
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].name < sources[j].name
+	})
+
+	tree := make(map[interface{}]interface{})
+	for _, src := range sources {
+		c, err := src.parse()
+		if err != nil {
+			return nil, err
+		}
+		spruceMutex.Lock()
+		tree, err = spruce.Merge(tree, c)
+		spruceMutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge %s: %w", src.ref, err)
+		}
+		logrus.Debug("loaded cluster substitutions: ", src.ref)
+	}
+	return tree, nil
+}
+
+type clusterSource struct {
+	ref  string
+	name string
+	data map[string][]byte
+}
+
+// Keys with a known file extension are parsed and merged, all other keys are added as strings
+func (src clusterSource) parse() (map[interface{}]interface{}, error) {
+	keys := make([]string, 0, len(src.data))
+	for k := range src.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tree := make(map[interface{}]interface{})
+	for _, key := range keys {
+		switch strings.ToLower(filepath.Ext(key)) {
+		case ".yaml", ".yml", ".json", ".toml", ".env", ".properties":
+			c, err := utils.ParseFormat(utils.DetectFormat(key, src.data[key]), src.data[key])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s in %s: %w", key, src.ref, err)
+			}
+			spruceMutex.Lock()
+			tree, err = spruce.Merge(tree, c)
+			spruceMutex.Unlock()
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge %s in %s: %w", key, src.ref, err)
+			}
+		default:
+			tree[key] = string(src.data[key])
+		}
+	}
+	return tree, nil
+}
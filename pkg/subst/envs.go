@@ -1,12 +1,23 @@
 package subst
 
 import (
+	"math"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 func GetVariables(regex string) (envs map[string]interface{}, err error) {
+	return getVariables(regex, os.Environ())
+}
+
+// returns the matching variables of the environment (KEY=value)
+func getVariables(regex string, environ []string) (envs map[string]interface{}, err error) {
 	envs = make(map[string]interface{})
 	var r *regexp.Regexp
 
@@ -17,7 +28,7 @@ func GetVariables(regex string) (envs map[string]interface{}, err error) {
 		}
 	}
 
-	for _, e := range os.Environ() {
+	for _, e := range environ {
 		pair := strings.SplitN(e, "=", 2)
 		key := pair[0]
 		value := pair[1]
@@ -39,3 +50,101 @@ func GetVariables(regex string) (envs map[string]interface{}, err error) {
 	}
 	return envs, nil
 }
+
+// Separator used to split environment variable names into nested keys
+const envNestingSeparator = "__"
+
+// ParseVariables converts flat environment variables into a substitution tree.
+// Keys are split on "__" into nested maps (CLUSTER__DNS__ZONE -> cluster.dns.zone when lowercase is set)
+// and values are converted to their native types (structures, booleans and numbers)
+func ParseVariables(envs map[string]interface{}, lowercase bool) map[interface{}]interface{} {
+	tree := make(map[interface{}]interface{})
+
+	// Sort keys for deterministic conflict resolution
+	keys := make([]string, 0, len(envs))
+	for k := range envs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := key
+		if lowercase {
+			name = strings.ToLower(name)
+		}
+
+		var path []string
+		for _, p := range strings.Split(name, envNestingSeparator) {
+			if p != "" {
+				path = append(path, p)
+			}
+		}
+		if len(path) == 0 {
+			continue
+		}
+
+		value := envs[key]
+		if s, ok := value.(string); ok {
+			value = parseValue(s)
+		}
+
+		node := tree
+		for _, p := range path[:len(path)-1] {
+			next, ok := node[p].(map[interface{}]interface{})
+			if !ok {
+				if node[p] != nil {
+					logrus.Warnf("environment variable %s overwrites value of %s", key, p)
+				}
+				next = make(map[interface{}]interface{})
+				node[p] = next
+			}
+			node = next
+		}
+
+		leaf := path[len(path)-1]
+		if _, ok := node[leaf].(map[interface{}]interface{}); ok {
+			logrus.Warnf("environment variable %s conflicts with nested variables, skipping", key)
+			continue
+		}
+		node[leaf] = value
+	}
+	return tree
+}
+
+// parseValue converts a string into a structure, boolean or number if it looks like one
+func parseValue(value string) interface{} {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return value
+	}
+
+	// JSON/YAML structures
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") || strings.Contains(trimmed, "\n") {
+		var structured interface{}
+		if err := yaml.Unmarshal([]byte(trimmed), &structured); err == nil {
+			switch structured.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return structured
+			}
+		}
+	}
+
+	switch strings.ToLower(trimmed) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	// Keep leading zeros (eg. zip codes, file modes) as strings
+	if len(trimmed) > 1 && trimmed[0] == '0' && trimmed[1] != '.' {
+		return value
+	}
+	if i, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(trimmed, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	return value
+}
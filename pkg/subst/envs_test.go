@@ -0,0 +1,109 @@
+package subst
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVariables(t *testing.T) {
+	tests := []struct {
+		name      string
+		envs      map[string]interface{}
+		lowercase bool
+		want      map[interface{}]interface{}
+	}{
+		{
+			name: "flat",
+			envs: map[string]interface{}{"REGION": "eu-west-1"},
+			want: map[interface{}]interface{}{"REGION": "eu-west-1"},
+		},
+		{
+			name: "nested",
+			envs: map[string]interface{}{"CLUSTER__DNS__ZONE": "example.com", "CLUSTER__NAME": "prod"},
+			want: map[interface{}]interface{}{
+				"CLUSTER": map[interface{}]interface{}{
+					"DNS":  map[interface{}]interface{}{"ZONE": "example.com"},
+					"NAME": "prod",
+				},
+			},
+		},
+		{
+			name:      "lowercase",
+			envs:      map[string]interface{}{"CLUSTER__DNS_ZONE": "example.com"},
+			lowercase: true,
+			want: map[interface{}]interface{}{
+				"cluster": map[interface{}]interface{}{"dns_zone": "example.com"},
+			},
+		},
+		{
+			name: "empty segments",
+			envs: map[string]interface{}{"__A____B__": "value", "__": "skipped"},
+			want: map[interface{}]interface{}{
+				"A": map[interface{}]interface{}{"B": "value"},
+			},
+		},
+		{
+			name: "types",
+			envs: map[string]interface{}{"BOOL": "True", "INT": "3", "FLOAT": "1.5", "ZIP": "01234", "LIST": "[a, b]"},
+			want: map[interface{}]interface{}{
+				"BOOL": true, "INT": int64(3), "FLOAT": 1.5, "ZIP": "01234", "LIST": []interface{}{"a", "b"},
+			},
+		},
+		{
+			name: "nested variables overwrite value",
+			envs: map[string]interface{}{"A": "value", "A__B": "nested"},
+			want: map[interface{}]interface{}{
+				"A": map[interface{}]interface{}{"B": "nested"},
+			},
+		},
+		{
+			name:      "value conflicting with nested variables",
+			envs:      map[string]interface{}{"a": "value", "A__B": "nested"},
+			lowercase: true,
+			want: map[interface{}]interface{}{
+				"a": map[interface{}]interface{}{"b": "nested"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseVariables(tt.envs, tt.lowercase); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVariables() = %v, %v expected", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  interface{}
+	}{
+		{"", ""},
+		{" ", " "},
+		{"text", "text"},
+		{"true", true},
+		{"FALSE", false},
+		{"42", int64(42)},
+		{"-7", int64(-7)},
+		{" 42 ", int64(42)},
+		{"0", int64(0)},
+		{"0.5", 0.5},
+		{"1e3", float64(1000)},
+		{"0755", "0755"},
+		{"1e999", "1e999"},
+		{"NaN", "NaN"},
+		{"Inf", "Inf"},
+		{"99999999999999999999", 1e20},
+		{"{a: 1}", map[interface{}]interface{}{"a": 1}},
+		{"[1, 2]", []interface{}{1, 2}},
+		{"a: 1\nb: 2", map[interface{}]interface{}{"a": 1, "b": 2}},
+		{"[unclosed", "[unclosed"},
+		{"yes", "yes"},
+	}
+	for _, tt := range tests {
+		if got := parseValue(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseValue(%q) = %#v, %#v expected", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package subst
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/geofffranks/spruce"
+	"github.com/starkandwayne/goutils/tree"
+)
+
+var (
+	ansiRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// Spruce errors are prefixed with the path of the operator ($.data.key: ...)
+	spruceFieldRegex = regexp.MustCompile(`^\s*(?:- )?\$\.(\S+): `)
+	operatorRegex    = regexp.MustCompile(`^\(\(\s*(\S+)`)
+	lineRegex        = regexp.MustCompile(`(?:line |template: [^:]+:)(\d+)(?::(\d+))?`)
+	columnRegex      = regexp.MustCompile(`column (\d+)`)
+)
+
+// DecryptError is returned if a substitution file or resource can't be decrypted
+type DecryptError struct {
+	// File which failed to decrypt
+	Path string
+	// ID of the resource which failed to decrypt
+	Resource string
+	Err      error
+}
+
+func (e *DecryptError) Error() string {
+	return describe("failed to decrypt", e.Path, e.Resource, e.Err)
+}
+
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+// EvalError is returned if spruce operators of a substitution file, kustomization or resource can't be evaluated
+type EvalError struct {
+	Path     string
+	Resource string
+	// Path of the operator within the document (eg. data.key)
+	Field string
+	// Name of the spruce operator (eg. grab)
+	Operator string
+	// Expression of the operator (eg. (( grab subst.key )))
+	Expression string
+	Err        error
+}
+
+func (e *EvalError) Error() string {
+	return describe("spruce evaluation failed", e.Path, e.Resource, e.Err)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned if a substitution file can't be parsed
+type ParseError struct {
+	Path   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	location := e.Path
+	if e.Line > 0 {
+		location += ":" + strconv.Itoa(e.Line)
+		if e.Column > 0 {
+			location += ":" + strconv.Itoa(e.Column)
+		}
+	}
+	return fmt.Sprintf("failed to parse %s: %s", location, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// KustomizeError is returned if the kustomization can't be resolved or built
+type KustomizeError struct {
+	Path string
+	Err  error
+}
+
+func (e *KustomizeError) Error() string {
+	return fmt.Sprintf("kustomize build failed for %s: %s", e.Path, e.Err)
+}
+
+func (e *KustomizeError) Unwrap() error {
+	return e.Err
+}
+
+// SecretError is returned if the decryption keys can't be loaded from the secret (with --secret-required)
+type SecretError struct {
+	Name      string
+	Namespace string
+	Err       error
+}
+
+func (e *SecretError) Error() string {
+	return fmt.Sprintf("failed to load decryption keys from secret %s/%s: %s", e.Namespace, e.Name, e.Err)
+}
+
+func (e *SecretError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorDetails is the machine readable representation of an error
+type ErrorDetails struct {
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+	Stage      string `json:"stage,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Line       int    `json:"line,omitempty"`
+	Column     int    `json:"column,omitempty"`
+	Resource   string `json:"resource,omitempty"`
+	Field      string `json:"field,omitempty"`
+	Operator   string `json:"operator,omitempty"`
+	Expression string `json:"expression,omitempty"`
+	Secret     string `json:"secret,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+// Details returns the details of the (wrapped) typed errors
+func Details(err error) ErrorDetails {
+	d := ErrorDetails{Type: "Error", Message: ansiRegex.ReplaceAllString(err.Error(), "")}
+
+	var renderErr *RenderError
+	if errors.As(err, &renderErr) {
+		d.Stage = renderErr.Stage
+	}
+
+	var (
+		decryptErr   *DecryptError
+		evalErr      *EvalError
+		parseErr     *ParseError
+		kustomizeErr *KustomizeError
+		secretErr    *SecretError
+	)
+	switch {
+	case errors.As(err, &decryptErr):
+		d.Type, d.Path, d.Resource = "DecryptError", decryptErr.Path, decryptErr.Resource
+	case errors.As(err, &evalErr):
+		d.Type, d.Path, d.Resource = "EvalError", evalErr.Path, evalErr.Resource
+		d.Field, d.Operator, d.Expression = evalErr.Field, evalErr.Operator, evalErr.Expression
+	case errors.As(err, &parseErr):
+		d.Type, d.Path, d.Line, d.Column = "ParseError", parseErr.Path, parseErr.Line, parseErr.Column
+	case errors.As(err, &kustomizeErr):
+		d.Type, d.Path = "KustomizeError", kustomizeErr.Path
+	case errors.As(err, &secretErr):
+		d.Type, d.Secret, d.Namespace = "SecretError", secretErr.Name, secretErr.Namespace
+	}
+	return d
+}
+
+// returns the message with the resource (or file) the error occurred in
+func describe(msg string, path string, resource string, err error) string {
+	switch {
+	case resource != "":
+		return fmt.Sprintf("%s %s: %s", msg, resource, err)
+	case path != "":
+		return fmt.Sprintf("%s %s: %s", msg, path, err)
+	}
+	return fmt.Sprintf("%s: %s", msg, err)
+}
+
+// returns the evaluation error, the operator is looked up in the evaluated data
+func evalError(path string, resource string, data map[interface{}]interface{}, err error) *EvalError {
+	e := &EvalError{Path: path, Resource: resource, Err: err}
+
+	msg := err.Error()
+	var multi spruce.MultiError
+	if errors.As(err, &multi) && len(multi.Errors) > 0 {
+		msg = multi.Errors[0].Error()
+	}
+	match := spruceFieldRegex.FindStringSubmatch(ansiRegex.ReplaceAllString(msg, ""))
+	if match == nil {
+		return e
+	}
+	e.Field = match[1]
+
+	cursor, cerr := tree.ParseCursor(e.Field)
+	if cerr != nil {
+		return e
+	}
+	if value, cerr := cursor.Resolve(data); cerr == nil {
+		if expr, ok := value.(string); ok {
+			e.Expression = strings.TrimSpace(expr)
+			if op := operatorRegex.FindStringSubmatch(e.Expression); op != nil {
+				e.Operator = op[1]
+			}
+		}
+	}
+	return e
+}
+
+// returns the parse error with the position of the error (if available)
+func parseError(path string, data []byte, err error) *ParseError {
+	e := &ParseError{Path: path, Err: err}
+
+	var syntaxErr *json.SyntaxError
+	var tomlErr toml.ParseError
+	switch {
+	case errors.As(err, &syntaxErr):
+		e.Line, e.Column = position(data, syntaxErr.Offset)
+	case errors.As(err, &tomlErr):
+		e.Line, e.Column = position(data, int64(tomlErr.Position.Start))
+	default:
+		msg := ansiRegex.ReplaceAllString(err.Error(), "")
+		if match := lineRegex.FindStringSubmatch(msg); match != nil {
+			e.Line, _ = strconv.Atoi(match[1])
+			e.Column, _ = strconv.Atoi(match[2])
+		}
+		if match := columnRegex.FindStringSubmatch(msg); match != nil && e.Column == 0 {
+			e.Column, _ = strconv.Atoi(match[1])
+		}
+	}
+	return e
+}
+
+// returns line and column of the byte offset
+func position(data []byte, offset int64) (line int, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, column = 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			column = 1
+			continue
+		}
+		column++
+	}
+	return line, column
+}
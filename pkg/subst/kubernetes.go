@@ -0,0 +1,190 @@
+package subst
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	decrypt "github.com/buttahtoast/pkg/decryptors"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// Service account credentials mounted into pods
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	// API server within the cluster, used if the service environment variables are not set (eg. ArgoCD plugin sidecars)
+	inClusterAPI = "https://kubernetes.default.svc"
+	// Attempts and backoff for loading the secret (also limited by the kubectl timeout)
+	secretAttempts   = 5
+	secretBackoff    = 250 * time.Millisecond
+	secretMaxBackoff = 4 * time.Second
+)
+
+// returns the configuration for requests to the cluster. In order of precedence: the kubeconfig, the token (and CA) files,
+// the in-cluster configuration and the mounted service account token
+func restConfig(cfg config.Configuration) (*rest.Config, error) {
+	if cfg.Kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags(cfg.KubeAPI, cfg.Kubeconfig)
+	}
+
+	if cfg.KubeTokenFile != "" {
+		logrus.Debugf("using token file %s", cfg.KubeTokenFile)
+		return tokenConfig(cfg.KubeAPI, cfg.KubeTokenFile, cfg.KubeCAFile)
+	}
+
+	c, err := rest.InClusterConfig()
+	if err == nil {
+		logrus.Debug("using in-cluster configuration")
+		if cfg.KubeAPI != "" {
+			c.Host = cfg.KubeAPI
+		}
+		if cfg.KubeCAFile != "" {
+			c.TLSClientConfig = rest.TLSClientConfig{CAFile: cfg.KubeCAFile}
+		}
+		return c, nil
+	}
+
+	// The service environment variables are not set, but the service account token is mounted
+	if _, err := os.Stat(serviceAccountTokenFile); err == nil {
+		logrus.Debug("using service account token")
+		ca := cfg.KubeCAFile
+		if ca == "" {
+			ca = serviceAccountCAFile
+		}
+		return tokenConfig(cfg.KubeAPI, serviceAccountTokenFile, ca)
+	}
+
+	return clientcmd.BuildConfigFromFlags(cfg.KubeAPI, "")
+}
+
+// returns the configuration authenticating with the token file. The token is reloaded when it's rotated
+func tokenConfig(host string, tokenFile string, caFile string) (*rest.Config, error) {
+	if host == "" {
+		host = inClusterAPI
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	c := &rest.Config{
+		Host:            host,
+		BearerTokenFile: tokenFile,
+	}
+	if caFile != "" {
+		if _, err := os.Stat(caFile); err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		c.TLSClientConfig = rest.TLSClientConfig{CAFile: caFile}
+	}
+	return c, nil
+}
+
+// loads the keys of the decryptors from the secret. Transient errors are retried with backoff
+// within the kubectl timeout, the first error is returned
+func (b *Build) keysFromSecret(ctx context.Context, decryptors []decrypt.Decryptor) error {
+	name, namespace := b.cfg.SecretName, b.cfg.SecretNamespace
+	client, err := b.kubernetesClient()
+	if err != nil {
+		return &SecretError{Name: name, Namespace: namespace, Err: fmt.Errorf("failed to create kubernetes client: %w", err)}
+	}
+
+	ctx, cancel := b.kubeContext(ctx)
+	defer cancel()
+
+	var first error
+	for _, decr := range decryptors {
+		err := retry(ctx, func() error {
+			return decr.KeysFromSecret(name, namespace, client, ctx)
+		})
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = &SecretError{Name: name, Namespace: namespace, Err: secretReason(err)}
+		}
+		// The API is not available for the other decryptors either
+		if transient(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return first
+}
+
+// returns the UID and resource version of the secret with the decryption keys, changes of the secret change
+// the version. Empty if the secret is not looked up
+func (b *Build) secretVersion(ctx context.Context) (string, error) {
+	if b.cfg.SkipDecrypt || b.cfg.SecretSkip || b.cfg.SecretName == "" || b.cfg.SecretNamespace == "" {
+		return "", nil
+	}
+	client, err := b.kubernetesClient()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := b.kubeContext(ctx)
+	defer cancel()
+
+	secret, err := client.CoreV1().Secrets(b.cfg.SecretNamespace).Get(ctx, b.cfg.SecretName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return "missing", nil
+	case err != nil:
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", secret.UID, secret.ResourceVersion), nil
+}
+
+// calls fn until it succeeds, the error is not transient or the attempts (or the context) are exhausted
+func retry(ctx context.Context, fn func() error) error {
+	backoff := secretBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !transient(err) || attempt == secretAttempts {
+			return err
+		}
+		logrus.Debugf("retrying in %s (attempt %d): %s", backoff, attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > secretMaxBackoff {
+			backoff = secretMaxBackoff
+		}
+	}
+}
+
+// returns true for errors which may succeed on retry (unavailable or overloaded API)
+func transient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err)
+}
+
+// returns the error with the reason the secret can't be read
+func secretReason(err error) error {
+	var missing *decrypt.MissingKubernetesSecret
+	switch {
+	case errors.As(err, &missing):
+		return err
+	case apierrors.IsForbidden(err):
+		return fmt.Errorf("access forbidden (the service account must be allowed to get the secret): %w", err)
+	case apierrors.IsUnauthorized(err):
+		return fmt.Errorf("unauthorized (check the kubeconfig or token): %w", err)
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package subst
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/buttahtoast/subst/internal/kustomize"
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"sigs.k8s.io/kustomize/api/resmap"
+)
+
+// Loads the substitutions of the paths which can be discovered without evaluating the kustomizations and
+// returns the function evaluating the kustomization files with them (before the build)
+func (b *Build) kustomizationEvaluator(ctx context.Context, opts kustomize.Options) (func(path string, data []byte) ([]byte, error), error) {
+	k, err := kustomize.Discover(b.cfg.RootDirectory, opts)
+	if err != nil {
+		return nil, &KustomizeError{Path: b.cfg.RootDirectory, Err: err}
+	}
+	logrus.Debug("pre-build paths: ", k.Paths)
+
+	// Resources are only substituted after the build
+	s, err := b.substitutions(ctx, k, resmap.New())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load substitutions for kustomization evaluation: %w", err)
+	}
+
+	return func(path string, data []byte) ([]byte, error) {
+		return s.EvalKustomization(path, data)
+	}, nil
+}
+
+// EvalKustomization renders go templates and evaluates spruce operators of a kustomization file
+func (s *Substitutions) EvalKustomization(path string, data []byte) ([]byte, error) {
+	if bytes.Contains(data, []byte("{{")) {
+		rendered, err := utils.Render(data, s.Subst)
+		if err != nil {
+			return nil, parseError(path, data, err)
+		}
+		data = rendered
+	}
+	if !bytes.Contains(data, []byte("((")) {
+		return data, nil
+	}
+
+	kz, err := utils.ParseYAML(data)
+	if err != nil {
+		return nil, parseError(path, data, err)
+	}
+	eval, err := s.Eval(kz, nil, false)
+	if err != nil {
+		return nil, evalError(path, "", kz, err)
+	}
+	return yaml.Marshal(eval)
+}
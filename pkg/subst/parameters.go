@@ -0,0 +1,199 @@
+package subst
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Parameters of the ArgoCD config management plugin (JSON)
+	// https://argo-cd.readthedocs.io/en/stable/operator-manual/config-management-plugins/#using-environment-variables-in-your-plugin
+	parametersVariable = "ARGOCD_APP_PARAMETERS"
+	// Separator of nested keys in parameter names (cluster.region)
+	parameterSeparator = "."
+)
+
+var (
+	// Prefixes of encrypted values (ejson, sops), which are announced without value (or empty within collections)
+	encryptedPrefixes = []string{"EJ[", "ENC["}
+	// Metadata of encrypted files (sops, ejson), which remains without decryption
+	encryptionKeys = []string{"sops", "_public_key"}
+)
+
+// Parameter of the ArgoCD config management plugin, used for announcements and values
+type Parameter struct {
+	Name           string            `json:"name"`
+	Title          string            `json:"title,omitempty"`
+	Tooltip        string            `json:"tooltip,omitempty"`
+	Required       bool              `json:"required,omitempty"`
+	ItemType       string            `json:"itemType,omitempty"`
+	CollectionType string            `json:"collectionType,omitempty"`
+	String         *string           `json:"string,omitempty"`
+	Array          []string          `json:"array,omitempty"`
+	Map            map[string]string `json:"map,omitempty"`
+}
+
+// overwrites the substitutions with the parameters of the application. Names are split on dots into nested keys,
+// maps are set per key. Values are converted like parsed environment variables (booleans, numbers)
+func (s *Substitutions) addParameters(getenv func(string) string) error {
+	raw := getenv(parametersVariable)
+	if raw == "" {
+		return nil
+	}
+	var params []Parameter
+	if err := json.Unmarshal([]byte(raw), &params); err != nil {
+		return parseError(parametersVariable, []byte(raw), err)
+	}
+
+	for _, p := range params {
+		if p.Name == "" {
+			continue
+		}
+		path := strings.Split(p.Name, parameterSeparator)
+		switch {
+		case p.Map != nil:
+			for k, v := range p.Map {
+				setPath(s.Subst, append(path[:len(path):len(path)], k), parseValue(v))
+			}
+		case p.Array != nil:
+			a := make([]interface{}, 0, len(p.Array))
+			for _, v := range p.Array {
+				a = append(a, parseValue(v))
+			}
+			setPath(s.Subst, path, a)
+		case p.String != nil:
+			setPath(s.Subst, path, parseValue(*p.String))
+		}
+	}
+	logrus.Debugf("loaded %d parameters", len(params))
+	return nil
+}
+
+// sets the value within the tree, missing (or non map) parents are replaced with maps
+func setPath(tree map[interface{}]interface{}, path []string, value interface{}) {
+	node := tree
+	for _, key := range path[:len(path)-1] {
+		next, ok := node[key].(map[interface{}]interface{})
+		if !ok {
+			next = make(map[interface{}]interface{})
+			node[key] = next
+		}
+		node = next
+	}
+	node[path[len(path)-1]] = value
+}
+
+// Parameters returns the announcement of the substitutions (from substitution files) as plugin parameters.
+// Scalars are announced as string, maps and lists of scalars as map and array. Nested maps are flattened
+// (names are joined with dots), encrypted values are announced without value. Build the substitutions
+// without cluster substitutions, their values (eg. of secrets) would be announced
+func (b *Build) Parameters() ([]Parameter, error) {
+	if b.Substitutions == nil {
+		return nil, fmt.Errorf("substitutions are not built")
+	}
+
+	// Built-in and environment substitutions and the metadata of encrypted files are not announced
+	skip := map[interface{}]bool{argocdField: true, gitField: true}
+	for _, key := range encryptionKeys {
+		skip[key] = true
+	}
+	environ := b.environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	envs, err := getVariables(b.cfg.EnvRegex, environ)
+	if err != nil {
+		return nil, err
+	}
+	for key := range b.Substitutions.environment(envs) {
+		skip[key] = true
+	}
+
+	var params []Parameter
+	for key, value := range b.Substitutions.Subst {
+		if skip[key] {
+			continue
+		}
+		params = appendParameters(params, fmt.Sprint(key), value)
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].Name < params[j].Name
+	})
+	return params, nil
+}
+
+// appends the parameters of the value
+func appendParameters(params []Parameter, name string, value interface{}) []Parameter {
+	p := Parameter{Name: name, Title: name}
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]string, len(v))
+		for key, item := range v {
+			s, ok := scalar(item)
+			if !ok {
+				// Nested structures are announced per key
+				for key, item := range v {
+					params = appendParameters(params, name+parameterSeparator+fmt.Sprint(key), item)
+				}
+				return params
+			}
+			if encrypted(s) {
+				s = ""
+			}
+			m[fmt.Sprint(key)] = s
+		}
+		p.CollectionType, p.Map = "map", m
+	case []interface{}:
+		a := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := scalar(item)
+			if !ok {
+				// Lists of structures can't be announced
+				return params
+			}
+			if encrypted(s) {
+				s = ""
+			}
+			a = append(a, s)
+		}
+		p.CollectionType, p.Array = "array", a
+	default:
+		s, ok := scalar(v)
+		if !ok {
+			return params
+		}
+		p.CollectionType = "string"
+		if !encrypted(s) {
+			p.String = &s
+		}
+	}
+	return append(params, p)
+}
+
+// returns the string of scalar values
+func scalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case map[interface{}]interface{}, []interface{}:
+		return "", false
+	case string:
+		return v, true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+func encrypted(value string) bool {
+	for _, prefix := range encryptedPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
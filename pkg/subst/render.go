@@ -0,0 +1,268 @@
+package subst
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	decrypt "github.com/buttahtoast/pkg/decryptors"
+	"github.com/buttahtoast/subst/pkg/config"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// Stages of the rendering (see RenderError)
+const (
+	StageKustomize     = "kustomize"
+	StageSubstitutions = "substitutions"
+	StageBuild         = "build"
+)
+
+// RenderError is returned by Render, it wraps the error of the failed stage
+type RenderError struct {
+	// Directory which was rendered
+	Dir string
+	// Stage which failed
+	Stage string
+	Err   error
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("%s failed for %s: %s", e.Stage, e.Dir, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// Option configures Render
+type Option func(*renderOptions)
+
+type renderOptions struct {
+	cfg        config.Configuration
+	fs         filesys.FileSystem
+	environ    []string
+	decryptors []decrypt.Decryptor
+	files      *FileCache
+	kubeClient *kubernetes.Clientset
+}
+
+// DefaultConfiguration returns the configuration with the defaults of the CLI flags
+func DefaultConfiguration() config.Configuration {
+	return config.Configuration{
+		EnvRegex:          "^ARGOCD_ENV_.*$",
+		FileRegex:         "(.*subst\\.yaml|.*(ejson))",
+		KubectlTimeout:    30 * time.Second,
+		ConvertSecretname: true,
+		SopsTempKeyring:   true,
+		ClusterPrecedence: ClusterPrecedenceLow,
+		LoadRestrictor:    "LoadRestrictionsNone",
+		AlphaPlugins:      true,
+		EnableHelm:        true,
+		HelmCommand:       "helm",
+		Reorder:           "none",
+	}
+}
+
+// WithConfiguration replaces the configuration (the root directory is always set by Render)
+func WithConfiguration(cfg config.Configuration) Option {
+	return func(o *renderOptions) {
+		o.cfg = cfg
+	}
+}
+
+// WithFileSystem renders from the given filesystem instead of the disk
+func WithFileSystem(fSys filesys.FileSystem) Option {
+	return func(o *renderOptions) {
+		o.fs = fSys
+	}
+}
+
+// WithFileRegex sets the pattern of substitution files
+func WithFileRegex(regex string) Option {
+	return func(o *renderOptions) {
+		o.cfg.FileRegex = regex
+	}
+}
+
+// WithEnvironmentRegex sets the pattern of environment variables exposed as substitutions
+func WithEnvironmentRegex(regex string) Option {
+	return func(o *renderOptions) {
+		o.cfg.EnvRegex = regex
+	}
+}
+
+// WithRecursive walks subdirectories of the paths up to depth (0 is unlimited)
+func WithRecursive(depth int) Option {
+	return func(o *renderOptions) {
+		o.cfg.Recursive = true
+		o.cfg.RecursiveDepth = depth
+	}
+}
+
+// WithEjsonKeys adds private keys for ejson decryption
+func WithEjsonKeys(keys ...string) Option {
+	return func(o *renderOptions) {
+		o.cfg.EjsonKey = append(o.cfg.EjsonKey, keys...)
+	}
+}
+
+// WithSecret loads the decryption keys from the secret
+func WithSecret(name string, namespace string) Option {
+	return func(o *renderOptions) {
+		o.cfg.SecretName = name
+		o.cfg.SecretNamespace = namespace
+	}
+}
+
+// WithKubeconfig sets the kubeconfig used for requests to the cluster
+func WithKubeconfig(path string) Option {
+	return func(o *renderOptions) {
+		o.cfg.Kubeconfig = path
+	}
+}
+
+// WithKubectlTimeout limits the requests to the cluster (0 disables the timeout)
+func WithKubectlTimeout(timeout time.Duration) Option {
+	return func(o *renderOptions) {
+		o.cfg.KubectlTimeout = timeout
+	}
+}
+
+// WithSkipDecrypt skips decryption
+func WithSkipDecrypt() Option {
+	return func(o *renderOptions) {
+		o.cfg.SkipDecrypt = true
+	}
+}
+
+// WithEnvironment replaces the process environment (for environment variables and ArgoCD metadata)
+func WithEnvironment(env map[string]string) Option {
+	return func(o *renderOptions) {
+		o.environ = make([]string, 0, len(env))
+		for k, v := range env {
+			o.environ = append(o.environ, k+"="+v)
+		}
+		sort.Strings(o.environ)
+	}
+}
+
+// WithDecryptors uses the initialized decryptors (see NewDecryptors) instead of creating them for each render
+func WithDecryptors(decryptors ...decrypt.Decryptor) Option {
+	return func(o *renderOptions) {
+		o.decryptors = decryptors
+	}
+}
+
+// WithFileCache shares the parsed substitution files with other renders using the same cache (see NewFileCache).
+// Renders sharing the cache must use the same decryptors
+func WithFileCache(files *FileCache) Option {
+	return func(o *renderOptions) {
+		o.files = files
+	}
+}
+
+// WithEvalKustomization evaluates the kustomization files with the substitutions before the build
+func WithEvalKustomization() Option {
+	return func(o *renderOptions) {
+		o.cfg.EvalKustomization = true
+	}
+}
+
+// Render builds the kustomization within dir and returns the substituted resources
+func Render(ctx context.Context, dir string, opts ...Option) ([]*unstructured.Unstructured, error) {
+	b, err := RenderBuild(ctx, dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := b.Resources()
+	if err != nil {
+		return nil, &RenderError{Dir: b.cfg.RootDirectory, Stage: StageBuild, Err: err}
+	}
+	return resources, nil
+}
+
+// RenderBuild builds the kustomization within dir and returns the build with the substituted manifests
+func RenderBuild(ctx context.Context, dir string, opts ...Option) (*Build, error) {
+	o := &renderOptions{cfg: DefaultConfiguration()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.fs == nil {
+		o.fs = filesys.MakeFsOnDisk()
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		dir = abs
+	}
+	o.cfg.RootDirectory = dir
+
+	fail := func(stage string, err error) error {
+		return &RenderError{Dir: dir, Stage: stage, Err: err}
+	}
+
+	b, err := newBuild(ctx, &Build{
+		cfg:        o.cfg,
+		fs:         o.fs,
+		environ:    o.environ,
+		shared:     o.decryptors,
+		files:      o.files,
+		kubeClient: o.kubeClient,
+	})
+	if err != nil {
+		return nil, fail(StageKustomize, err)
+	}
+	defer b.Close()
+	if err := ctx.Err(); err != nil {
+		return nil, fail(StageKustomize, err)
+	}
+	if err := b.BuildSubstitutionsContext(ctx); err != nil {
+		return nil, fail(StageSubstitutions, err)
+	}
+	if err := b.BuildContext(ctx); err != nil {
+		return nil, fail(StageBuild, err)
+	}
+	return b, nil
+}
+
+// NewDecryptors initializes the decryptors of the configuration (including the keys of the secret).
+// The decryptors can be used by concurrent renders, the returned function removes temporary keyrings
+func NewDecryptors(ctx context.Context, cfg config.Configuration) ([]decrypt.Decryptor, func(), error) {
+	b := &Build{cfg: cfg}
+	decryptors, cleanups, err := b.decryptors(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lockDecryptors(decryptors), func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}, nil
+}
+
+// Resources returns the substituted manifests as unstructured resources
+func (b *Build) Resources() ([]*unstructured.Unstructured, error) {
+	resources := make([]*unstructured.Unstructured, 0, len(b.Manifests))
+	for _, manifest := range b.Manifests {
+		y, err := yaml.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		j, err := k8syaml.YAMLToJSON(y)
+		if err != nil {
+			return nil, err
+		}
+		u := &unstructured.Unstructured{}
+		if err := u.UnmarshalJSON(j); err != nil {
+			return nil, err
+		}
+		resources = append(resources, u)
+	}
+	return resources, nil
+}
@@ -0,0 +1,352 @@
+package subst
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	decrypt "github.com/buttahtoast/pkg/decryptors"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Maximum size of a render request body
+	maxRequestSize = 1 << 20
+)
+
+// ServerOptions configures the render server
+type ServerOptions struct {
+	// Relative directories are resolved within the base directory, directories outside of it are rejected (required)
+	BaseDir string
+	// Maximum number of concurrent renders, further requests wait for a free slot
+	MaxConcurrent int
+	// Timeout of a render request (including the wait for a free slot)
+	Timeout time.Duration
+	// Lifetime of initialized decryptors, afterwards the keys are loaded again
+	DecryptorTTL time.Duration
+}
+
+// RenderRequest is the body of a render request
+type RenderRequest struct {
+	// Directory of the kustomization
+	Directory string `json:"directory"`
+	// Environment of the render (eg. ARGOCD_ENV_* and ARGOCD_APP_* variables), the server environment is not used.
+	// Without --secret-name the secret with the decryption keys is derived from ARGOCD_APP_NAME and ARGOCD_APP_NAMESPACE
+	Env map[string]string `json:"env,omitempty"`
+	// Output format: yaml (stream of documents) or json (array)
+	Output string `json:"output,omitempty"`
+}
+
+// Server renders kustomizations over HTTP. Decryptors (by secret) and the kubernetes client are kept between requests.
+// The API is not authenticated, every client can render with the keys of all secrets the server can read
+type Server struct {
+	cfg   config.Configuration
+	opts  ServerOptions
+	slots chan struct{}
+
+	mu         sync.Mutex
+	decryptors map[string]*decryptorEntry
+	kubeClient *kubernetes.Clientset
+}
+
+// initialized decryptors of a secret, shared by concurrent renders (see lockDecryptors)
+type decryptorEntry struct {
+	// Held during the initialization
+	mu         sync.Mutex
+	decryptors []decrypt.Decryptor
+	cleanup    func()
+	expires    time.Time
+	// Renders using the entry and whether it was removed from the server (guarded by the server mutex),
+	// removed entries are closed by the last render
+	refs    int
+	removed bool
+}
+
+// NewServer returns the server, the configuration is the base for all requests
+func NewServer(cfg config.Configuration, opts ServerOptions) (*Server, error) {
+	if opts.MaxConcurrent < 1 {
+		return nil, fmt.Errorf("max concurrent renders must be at least 1")
+	}
+	if opts.BaseDir == "" {
+		return nil, fmt.Errorf("base directory is required")
+	}
+	base, err := filepath.Abs(opts.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	opts.BaseDir = base
+	return &Server{
+		cfg:        cfg,
+		opts:       opts,
+		slots:      make(chan struct{}, opts.MaxConcurrent),
+		decryptors: make(map[string]*decryptorEntry),
+	}, nil
+}
+
+// Handler returns the HTTP handler (POST /render, GET /healthz)
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/render", s.handleRender)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// Close removes the temporary keyrings of the decryptors (once the running renders are done)
+func (s *Server) Close() {
+	s.mu.Lock()
+	var idle []*decryptorEntry
+	for key, e := range s.decryptors {
+		if s.remove(key, e) {
+			idle = append(idle, e)
+		}
+	}
+	s.mu.Unlock()
+	for _, e := range idle {
+		e.close()
+	}
+}
+
+func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req RenderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	dir, err := s.directory(req.Directory)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	output := req.Output
+	if output == "" {
+		output = s.cfg.Output
+	}
+
+	ctx := r.Context()
+	if s.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.Timeout)
+		defer cancel()
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		s.writeError(w, http.StatusServiceUnavailable, fmt.Errorf("no free render slot: %w", ctx.Err()))
+		return
+	}
+
+	start := time.Now()
+	resources, err := s.render(ctx, dir, req.Env)
+	if err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		s.writeError(w, status, err)
+		return
+	}
+	logrus.Debugf("rendered %s in %s", dir, time.Since(start))
+
+	if err := writeResources(w, resources, output); err != nil {
+		logrus.Warnf("failed to write response: %s", err)
+	}
+}
+
+// renders the directory with the environment of the request
+func (s *Server) render(ctx context.Context, dir string, env map[string]string) ([]*unstructured.Unstructured, error) {
+	// Without a configured secret, the secret is derived from the application of the request
+	cfg := s.cfg
+	if cfg.SecretName == "" {
+		if err := cfg.ResolveSecret(func(key string) string { return env[key] }); err != nil {
+			return nil, err
+		}
+	}
+
+	var client *kubernetes.Clientset
+	if cfg.SecretName != "" || cfg.ClusterSelector != "" {
+		client = s.kubernetesClient()
+	}
+
+	e, err := s.decryptorEntry(ctx, cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(e)
+
+	return Render(ctx, dir,
+		WithConfiguration(cfg),
+		WithEnvironment(env),
+		WithDecryptors(e.decryptors...),
+		withKubeClient(client),
+	)
+}
+
+// returns the decryptors for the secret of the configuration, initializes them if required.
+// The entry must be released after the render
+func (s *Server) decryptorEntry(ctx context.Context, cfg config.Configuration, client *kubernetes.Clientset) (*decryptorEntry, error) {
+	key := cfg.SecretNamespace + "/" + cfg.SecretName
+
+	s.mu.Lock()
+	e, ok := s.decryptors[key]
+	if ok && s.opts.DecryptorTTL > 0 && time.Now().After(e.expires) {
+		if s.remove(key, e) {
+			go e.close()
+		}
+		ok = false
+	}
+	if !ok {
+		e = &decryptorEntry{expires: time.Now().Add(s.opts.DecryptorTTL)}
+		s.decryptors[key] = e
+	}
+	e.refs++
+	s.mu.Unlock()
+
+	if err := e.init(ctx, key, cfg, client); err != nil {
+		s.release(e)
+		return nil, err
+	}
+	return e, nil
+}
+
+// initializes the decryptors, unless a previous render did
+func (e *decryptorEntry) init(ctx context.Context, key string, cfg config.Configuration, client *kubernetes.Clientset) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.decryptors != nil {
+		return nil
+	}
+	b := &Build{cfg: cfg, kubeClient: client}
+	decryptors, cleanups, err := b.decryptors(ctx)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("initialized decryptors for %s", key)
+	e.decryptors = lockDecryptors(decryptors)
+	e.cleanup = func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+	return nil
+}
+
+// removes the entry from the server, returns true if no render uses it (the caller closes it).
+// Requires the server mutex
+func (s *Server) remove(key string, e *decryptorEntry) bool {
+	if s.decryptors[key] == e {
+		delete(s.decryptors, key)
+	}
+	e.removed = true
+	return e.refs == 0
+}
+
+// releases the entry after a render, the last render closes removed entries
+func (s *Server) release(e *decryptorEntry) {
+	s.mu.Lock()
+	e.refs--
+	idle := e.removed && e.refs == 0
+	s.mu.Unlock()
+	if idle {
+		e.close()
+	}
+}
+
+func (e *decryptorEntry) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cleanup != nil {
+		e.cleanup()
+	}
+	e.decryptors, e.cleanup = nil, nil
+}
+
+// returns the shared kubernetes client (nil if it can't be created, each render then tries again)
+func (s *Server) kubernetesClient() *kubernetes.Clientset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kubeClient == nil {
+		b := &Build{cfg: s.cfg}
+		client, err := b.kubernetesClient()
+		if err != nil {
+			logrus.Debugf("could not load kubernetes client: %s", err)
+			return nil
+		}
+		s.kubeClient = client
+	}
+	return s.kubeClient
+}
+
+// resolves the requested directory within the base directory
+func (s *Server) directory(dir string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("directory is required")
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.opts.BaseDir, dir)
+	}
+	dir = filepath.Clean(dir)
+	rel, err := filepath.Rel(s.opts.BaseDir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("directory %s is outside of the base directory", dir)
+	}
+	return dir, nil
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	logrus.Warnf("render request failed: %s", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Details(err))
+}
+
+// writes the resources as yaml stream or json array
+func writeResources(w http.ResponseWriter, resources []*unstructured.Unstructured, output string) error {
+	if output == "json" {
+		items := make([]map[string]interface{}, 0, len(resources))
+		for _, r := range resources {
+			items = append(items, r.Object)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(items)
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	for _, r := range resources {
+		y, err := yaml.Marshal(r.Object)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append([]byte("---\n"), y...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uses the kubernetes client for the render (nil creates a new client)
+func withKubeClient(client *kubernetes.Clientset) Option {
+	return func(o *renderOptions) {
+		o.kubeClient = client
+	}
+}
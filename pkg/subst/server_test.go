@@ -0,0 +1,81 @@
+package subst
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerDecryptors(t *testing.T) {
+	cfg := DefaultConfiguration()
+	cfg.SopsTempKeyring = false
+	cfg.SecretSkip = true
+	s, err := NewServer(cfg, ServerOptions{BaseDir: t.TempDir(), MaxConcurrent: 2, DecryptorTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Concurrent renders share the decryptors
+	first, err := s.decryptorEntry(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.decryptorEntry(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || first.refs != 2 {
+		t.Fatalf("entries not shared (refs %d)", first.refs)
+	}
+
+	// Expired entries are replaced, but only closed by the last render using them
+	first.expires = time.Now().Add(-time.Second)
+	third, err := s.decryptorEntry(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Fatal("expired entry reused")
+	}
+	s.release(first)
+	if first.decryptors == nil {
+		t.Fatal("entry closed while in use")
+	}
+	s.release(second)
+	if first.decryptors != nil {
+		t.Fatal("entry not closed after the last render")
+	}
+
+	s.release(third)
+	s.Close()
+	if third.decryptors != nil || len(s.decryptors) != 0 {
+		t.Fatal("entries not closed by the server")
+	}
+}
+
+func TestServerSecret(t *testing.T) {
+	base := t.TempDir()
+	writeTestFile(t, base, "app/kustomization.yaml", "resources: []\n")
+
+	cfg := DefaultConfiguration()
+	cfg.SopsTempKeyring = false
+	cfg.SkipGit = true
+	cfg.EnableHelm = false
+	cfg.Kubeconfig = filepath.Join(t.TempDir(), "kubeconfig")
+	s, err := NewServer(cfg, ServerOptions{BaseDir: base, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The secret is derived from the application of the request
+	env := map[string]string{"ARGOCD_APP_NAME": "app", "ARGOCD_APP_NAMESPACE": "argocd"}
+	if _, err := s.render(context.Background(), filepath.Join(base, "app"), env); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.decryptors["argocd/app"]; !ok {
+		t.Fatalf("no decryptors for the secret of the request: %v", s.decryptors)
+	}
+}
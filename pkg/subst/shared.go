@@ -0,0 +1,111 @@
+package subst
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	decrypt "github.com/buttahtoast/pkg/decryptors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FileCache shares the parsed (and decrypted) substitution files between builds, eg. the common bases of
+// several overlays. Entries are addressed by the path and the content of the file, templated files
+// depend on the substitutions of the build and are not shared
+type FileCache struct {
+	mu    sync.Mutex
+	files map[fileCacheKey]fileCacheEntry
+}
+
+type fileCacheKey struct {
+	path string
+	sum  [sha256.Size]byte
+}
+
+type fileCacheEntry struct {
+	data      map[interface{}]interface{}
+	decrypted bool
+}
+
+// NewFileCache returns an empty cache
+func NewFileCache() *FileCache {
+	return &FileCache{files: make(map[fileCacheKey]fileCacheEntry)}
+}
+
+// returns a copy of the parsed file, builds modify the data while loading it
+func (c *FileCache) get(path string, content []byte) (map[interface{}]interface{}, bool, bool) {
+	c.mu.Lock()
+	entry, ok := c.files[fileCacheKey{path, sha256.Sum256(content)}]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false, false
+	}
+	return copyTree(entry.data).(map[interface{}]interface{}), entry.decrypted, true
+}
+
+func (c *FileCache) put(path string, content []byte, data map[interface{}]interface{}, decrypted bool) {
+	entry := fileCacheEntry{data: copyTree(data).(map[interface{}]interface{}), decrypted: decrypted}
+	c.mu.Lock()
+	c.files[fileCacheKey{path, sha256.Sum256(content)}] = entry
+	c.mu.Unlock()
+}
+
+// returns a deep copy of the maps and slices of the parsed data
+func copyTree(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for k, v := range t {
+			m[k] = copyTree(v)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = copyTree(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, v := range t {
+			s[i] = copyTree(v)
+		}
+		return s
+	}
+	return v
+}
+
+// lockedDecryptor serializes the calls of decryptors shared by concurrent builds
+// (the decryptors keep the keys and keyrings in their state)
+type lockedDecryptor struct {
+	mu *sync.Mutex
+	d  decrypt.Decryptor
+}
+
+func (l *lockedDecryptor) IsEncrypted(data []byte) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.d.IsEncrypted(data)
+}
+
+func (l *lockedDecryptor) Decrypt(data []byte) (map[string]interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.d.Decrypt(data)
+}
+
+func (l *lockedDecryptor) KeysFromSecret(secretName string, namespace string, client *kubernetes.Clientset, ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.d.KeysFromSecret(secretName, namespace, client, ctx)
+}
+
+// wraps the decryptors with one lock, so they can be shared by concurrent builds
+func lockDecryptors(decryptors []decrypt.Decryptor) []decrypt.Decryptor {
+	mu := &sync.Mutex{}
+	locked := make([]decrypt.Decryptor, len(decryptors))
+	for i, d := range decryptors {
+		locked[i] = &lockedDecryptor{mu: mu, d: d}
+	}
+	return locked
+}
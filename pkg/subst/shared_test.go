@@ -0,0 +1,51 @@
+package subst
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileCache(t *testing.T) {
+	files := NewFileCache()
+	content := []byte("a:\n  b: [1, 2]\n")
+	data := map[interface{}]interface{}{
+		"a": map[interface{}]interface{}{"b": []interface{}{1, 2}},
+	}
+	want := copyTree(data)
+	files.put("/base/subst.yaml", content, data, true)
+
+	// The stored entry is not modified by the build which parsed the file
+	data["a"].(map[interface{}]interface{})["b"] = "changed"
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		content []byte
+		found   bool
+	}{
+		{"same file", "/base/subst.yaml", content, true},
+		{"changed content", "/base/subst.yaml", []byte("a: {}\n"), false},
+		{"other path", "/overlay/subst.yaml", content, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, decrypted, ok := files.get(tc.path, tc.content)
+			if ok != tc.found {
+				t.Fatalf("found %t, want %t", ok, tc.found)
+			}
+			if !ok {
+				return
+			}
+			if !decrypted {
+				t.Fatal("entry is not marked as decrypted")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			// Builds modify the returned data
+			delete(got, "a")
+			if again, _, _ := files.get(tc.path, tc.content); !reflect.DeepEqual(again, want) {
+				t.Fatalf("entry was modified: %v", again)
+			}
+		})
+	}
+}
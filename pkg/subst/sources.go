@@ -0,0 +1,210 @@
+package subst
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buttahtoast/subst/internal/git"
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	sourcesField = "sources"
+)
+
+var (
+	sourceHTTPTimeout = 30 * time.Second
+)
+
+// Source is a remote substitution file declared within a substitution file
+type Source struct {
+	URL    string     `yaml:"url"`
+	SHA256 string     `yaml:"sha256"`
+	Git    *GitSource `yaml:"git"`
+}
+
+// GitSource references a file within a git repository
+type GitSource struct {
+	Repository string `yaml:"repository"`
+	Ref        string `yaml:"ref"`
+	Path       string `yaml:"path"`
+}
+
+func (src Source) String() string {
+	if src.Git != nil {
+		return fmt.Sprintf("%s//%s?ref=%s", src.Git.Repository, src.Git.Path, src.Git.Ref)
+	}
+	return src.URL
+}
+
+func (src Source) validate() error {
+	switch {
+	case src.URL != "" && src.Git != nil:
+		return fmt.Errorf("source %s: url and git are mutually exclusive", src)
+	case src.URL != "":
+		u, err := url.Parse(src.URL)
+		if err != nil {
+			return fmt.Errorf("source %s: %w", src, err)
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("source %s: unsupported scheme %q (only https is supported)", src, u.Scheme)
+		}
+		if src.SHA256 == "" {
+			return fmt.Errorf("source %s: sha256 is required for url sources", src)
+		}
+	case src.Git != nil:
+		if src.Git.Repository == "" || src.Git.Path == "" {
+			return fmt.Errorf("source %s: git repository and path are required", src)
+		}
+		if err := git.ValidateRemote(src.Git.Repository, src.Git.Ref); err != nil {
+			return fmt.Errorf("source %s: %w", src, err)
+		}
+		if src.SHA256 != "" {
+			return fmt.Errorf("source %s: sha256 is only supported for url sources", src)
+		}
+	default:
+		return fmt.Errorf("source must either declare url or git")
+	}
+	return nil
+}
+
+// Adds the sources in the given order, sources are merged before the declaring file
+func (s *Substitutions) addSources(in interface{}) (err error) {
+	raw, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var sources []Source
+	if err := yaml.UnmarshalStrict(raw, &sources); err != nil {
+		return fmt.Errorf("invalid sources: %w", err)
+	}
+
+	s.remote = true
+	for _, src := range sources {
+		if err := src.validate(); err != nil {
+			return err
+		}
+		data, err := s.fetchSource(src)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", src, err)
+		}
+
+		name := src.URL
+		if src.Git != nil {
+			name = src.Git.Path
+		}
+		c, err := s.read(utils.NewFileFromBytes(name, data))
+		if err != nil {
+			return err
+		}
+		if err := checkReserved(c, src.String()); err != nil {
+			return err
+		}
+		if c[sourcesField] != nil {
+			logrus.Warnf("ignoring nested sources in %s", src)
+			delete(c, sourcesField)
+		}
+		if c[resourcesField] != nil {
+			logrus.Warnf("ignoring resources in %s", src)
+			delete(c, resourcesField)
+		}
+
+		if err := s.Add(c, true); err != nil {
+			return fmt.Errorf("failed to merge %s: %s", src, err)
+		}
+		logrus.Debug("loaded source: ", src.String())
+	}
+	return nil
+}
+
+// returns the content of the source, either from cache or remote
+func (s *Substitutions) fetchSource(src Source) ([]byte, error) {
+	if src.Git != nil {
+		return s.fetchGit(*src.Git)
+	}
+	return s.fetchURL(src)
+}
+
+func (s *Substitutions) fetchURL(src Source) ([]byte, error) {
+	cached := filepath.Join(s.Config.CacheDir, "http", hash(src.URL))
+
+	// Pinned sources are served from cache, if the checksum matches
+	if data, err := os.ReadFile(cached); err == nil {
+		pinned := src.SHA256 != "" && verifyChecksum(data, src.SHA256) == nil
+		if pinned || s.Config.Offline {
+			logrus.Debugf("using cached %s", src.URL)
+			if err := verifyChecksum(data, src.SHA256); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+	} else if s.Config.Offline {
+		return nil, fmt.Errorf("offline mode and no cached copy available")
+	}
+
+	client := &http.Client{Timeout: sourceHTTPTimeout}
+	resp, err := client.Get(src.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(data, src.SHA256); err != nil {
+		return nil, err
+	}
+
+	if err := utils.WriteFileAtomic(cached, data); err != nil {
+		logrus.Warnf("failed to cache %s: %s", src.URL, err)
+	}
+	return data, nil
+}
+
+func (s *Substitutions) fetchGit(src GitSource) ([]byte, error) {
+	entry := filepath.Join(s.Config.CacheDir, "git", hash(src.Repository+"@"+git.NormalizeRef(src.Ref)))
+	dir, err := git.Fetch(src.Repository, src.Ref, entry, s.Config.Offline)
+	if err != nil {
+		return nil, err
+	}
+	return git.ReadFile(dir, src.Path)
+}
+
+func verifyChecksum(data []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+func hash(in string) string {
+	sum := sha256.Sum256([]byte(in))
+	return hex.EncodeToString(sum[:])
+}
+
+// DefaultCacheDir returns the default directory for cached remote sources
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "subst")
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"text/template"
 
 	decrypt "github.com/buttahtoast/pkg/decryptors"
@@ -14,10 +17,12 @@ import (
 	"github.com/geofffranks/spruce"
 	"github.com/sirupsen/logrus"
 	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
 )
 
 var (
-	matchingRegex *regexp.Regexp
+	// Spruce keeps the state of prune and sort operators in globals, merges and evaluations can't run concurrently
+	spruceMutex sync.Mutex
 )
 
 type Substitutions struct {
@@ -25,14 +30,28 @@ type Substitutions struct {
 	Config     SubstitutionsConfig         `yaml:"config"`
 	decryptors []decrypt.Decryptor
 	funcmap    template.FuncMap
-	Resources  resmap.ResMap
+	// Substitution files (per instance, substitutions are built concurrently)
+	fileRegex *regexp.Regexp
+	Resources resmap.ResMap
+	// Decrypted files or remote sources were loaded (see RenderCache)
+	decrypted bool
+	remote    bool
 }
 
 type SubstitutionsConfig struct {
 	SubstKey         string `yaml:"subst_key"`
 	EnvironmentRegex string `yaml:"environment_regex"`
+	EnvironmentParse bool   `yaml:"environment_parse"`
 	SubstFileRegex   string `yaml:"subst_file_pattern"`
 	FlattenLowerCase bool   `yaml:"lowercase"`
+	CacheDir         string `yaml:"cache_dir"`
+	Offline          bool   `yaml:"offline"`
+	// Filesystem the substitution files are read from (defaults to disk)
+	FileSystem filesys.FileSystem `yaml:"-"`
+	// Environment variables (KEY=value) used instead of the process environment
+	Environment []string `yaml:"-"`
+	// Parsed substitution files shared with other builds (optional)
+	Files *FileCache `yaml:"-"`
 }
 
 func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res resmap.ResMap) (s *Substitutions, err error) {
@@ -41,6 +60,14 @@ func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res
 		cfg.SubstKey = "subst"
 	}
 
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = DefaultCacheDir()
+	}
+
+	if cfg.FileSystem == nil {
+		cfg.FileSystem = filesys.MakeFsOnDisk()
+	}
+
 	init := &Substitutions{
 		Subst:      make(map[interface{}]interface{}),
 		Config:     cfg,
@@ -49,7 +76,7 @@ func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res
 	}
 
 	if init.Config.SubstFileRegex != "" {
-		matchingRegex, err = regexp.Compile(init.Config.SubstFileRegex)
+		init.fileRegex, err = regexp.Compile(init.Config.SubstFileRegex)
 		if err != nil {
 			return nil, err
 		}
@@ -60,11 +87,15 @@ func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res
 	// Load sprig functionMap
 	init.funcmap = utils.SprigFuncMap()
 
-	envs, err := GetVariables(cfg.EnvironmentRegex)
+	environ := cfg.Environment
+	if environ == nil {
+		environ = os.Environ()
+	}
+	envs, err := getVariables(cfg.EnvironmentRegex, environ)
 	if err != nil {
 		return nil, err
 	}
-	init.Add(utils.ToInterface(envs), true)
+	err = init.Add(init.environment(envs), true)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +103,22 @@ func NewSubstitutions(cfg SubstitutionsConfig, decrypts []decrypt.Decryptor, res
 	return init, nil
 }
 
+// converts environment variables according to the configuration
+func (s *Substitutions) environment(envs map[string]interface{}) map[interface{}]interface{} {
+	if s.Config.EnvironmentParse {
+		return ParseVariables(envs, s.Config.FlattenLowerCase)
+	}
+
+	vars := make(map[interface{}]interface{})
+	for k, v := range envs {
+		if s.Config.FlattenLowerCase {
+			k = strings.ToLower(k)
+		}
+		vars[k] = v
+	}
+	return vars
+}
+
 // Get returns the Substitutions as map[interface{}]interface{}
 func (s *Substitutions) Get() map[interface{}]interface{} {
 	return s.Subst
@@ -87,10 +134,12 @@ func (s *Substitutions) Add(data map[interface{}]interface{}, optimistic bool) (
 
 	tree, err := s.Eval(data, nil, optimistic)
 	if err != nil {
-		return fmt.Errorf("failed to build subtitutions: %s", err)
+		return fmt.Errorf("failed to build subtitutions: %w", err)
 	}
 
+	spruceMutex.Lock()
 	merge, err := spruce.Merge(s.Get(), tree)
+	spruceMutex.Unlock()
 	if err != nil {
 		return fmt.Errorf("could not merge manifest with subtitutions: %s", err)
 	}
@@ -109,6 +158,9 @@ func (s *Substitutions) Eval(data map[interface{}]interface{}, substs map[interf
 		s.Config.SubstKey: substs,
 	}
 
+	spruceMutex.Lock()
+	defer spruceMutex.Unlock()
+
 	merge, err := spruce.Merge(data, sub)
 	if err != nil {
 		return nil, fmt.Errorf("could not merge manifest with subtitutions: %s", err)
@@ -137,61 +189,97 @@ func (s *Substitutions) Walk(path string, f fs.FileInfo) error {
 	}
 	full := filepath.Join(path, f.Name())
 
-	if matchingRegex.MatchString(f.Name()) {
-		var c map[interface{}]interface{}
+	if s.fileRegex != nil && s.fileRegex.MatchString(f.Name()) {
 		logrus.Debug("processing: ", full, "")
-		file, err := utils.NewFile(full)
+		data, err := s.Config.FileSystem.ReadFile(full)
 		if err != nil {
 			return err
 		}
+		file := utils.NewFileFromBytes(full, data)
 
-		c, err = file.SPRUCE()
+		c, err := s.read(file)
 		if err != nil {
-			if c, err = utils.Template(file.Byte(), s.Subst); err != nil {
-				return fmt.Errorf("failed to template %s: %s", full, err)
-			}
+			return err
+		}
+		if err := checkReserved(c, full); err != nil {
+			return err
 		}
 
-		// Read encrypted file
-		for _, d := range s.decryptors {
-			isEncrypted, _ := d.IsEncrypted(file.Byte())
+		if c[sourcesField] != nil {
+			logrus.Debugf("detected sources in %s", full)
+			err = s.addSources(c[sourcesField])
 			if err != nil {
-				break
-			}
-			if isEncrypted {
-				logrus.Debugf("decrypted: %s", full)
-				file.Byte()
-				dm, err := d.Decrypt(file.Byte())
-				if err != nil {
-					return fmt.Errorf("failed to decrypt %s: %s", full, err)
-				}
-				t, err := json.Marshal(dm)
-				if err != nil {
-					return fmt.Errorf("failed to marshal %s: %s", full, err)
-				}
-				c, err = utils.ParseYAML(t)
-				if err != nil {
-					return fmt.Errorf("failed to parse %s: %s", full, err)
-				}
-				break
+				return fmt.Errorf("failed to add sources from %s: %w", full, err)
 			}
+			delete(c, sourcesField)
 		}
 
 		if c[resourcesField] != nil {
 			logrus.Debugf("detected resources in %s", full)
 			err = s.addResources(c[resourcesField].([]interface{}))
 			if err != nil {
-				return fmt.Errorf("failed to add resources from %s: %s", full, err)
+				return fmt.Errorf("failed to add resources from %s: %w", full, err)
 			}
 			delete(c, resourcesField)
 		}
 
 		err = s.Add(c, true)
 		if err != nil {
-			return fmt.Errorf("failed to merge %s: %s", full, err)
+			return evalError(full, "", c, err)
 		}
 
 		logrus.Debug("loaded: ", full, "")
 	}
 	return nil
 }
+
+// parses (or templates) and decrypts a substitution file. Parsed files are shared with the file cache
+func (s *Substitutions) read(file *utils.File) (c map[interface{}]interface{}, err error) {
+	if s.Config.Files != nil {
+		if c, decrypted, ok := s.Config.Files.get(file.Path, file.Byte()); ok {
+			logrus.Debugf("shared: %s", file.Path)
+			s.decrypted = s.decrypted || decrypted
+			return c, nil
+		}
+	}
+
+	templated := false
+	c, err = file.Parse()
+	if err != nil {
+		if c, err = file.Template(s.Subst); err != nil {
+			return nil, parseError(file.Path, file.Byte(), err)
+		}
+		templated = true
+	}
+	decrypted := false
+
+	// Read encrypted file
+	for _, d := range s.decryptors {
+		isEncrypted, err := d.IsEncrypted(file.Byte())
+		if err != nil {
+			continue
+		}
+		if isEncrypted {
+			logrus.Debugf("decrypted: %s", file.Path)
+			dm, err := d.Decrypt(file.Byte())
+			if err != nil {
+				return nil, &DecryptError{Path: file.Path, Err: err}
+			}
+			decrypted = true
+			t, err := json.Marshal(dm)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %s: %s", file.Path, err)
+			}
+			c, err = utils.ParseYAML(t)
+			if err != nil {
+				return nil, parseError(file.Path, t, err)
+			}
+			break
+		}
+	}
+	s.decrypted = s.decrypted || decrypted
+	if s.Config.Files != nil && !templated {
+		s.Config.Files.put(file.Path, file.Byte(), c, decrypted)
+	}
+	return c, nil
+}
@@ -24,10 +24,11 @@ func newDiscoverCmd() *cobra.Command {
 }
 
 func discover(cmd *cobra.Command, args []string) error {
-	dir, err := rootDirectory(args)
+	dir, cleanup, err := rootDirectory(args)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
 
 	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
 	if err != nil {
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/buttahtoast/subst/internal/argocd"
+	"github.com/buttahtoast/subst/internal/git"
+	"github.com/buttahtoast/subst/internal/kustomize"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+)
+
+func newGenerateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate ArgoCD resources",
+	}
+	cmd.AddCommand(newGenerateAppsCmd())
+	return cmd
+}
+
+func newGenerateAppsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apps",
+		Short: "Generate ArgoCD applications for overlays",
+		Long: heredoc.Doc(`
+			Run 'subst generate apps' to generate an ArgoCD Application (or a single ApplicationSet) for each overlay within the directory.
+			Overlays are the kustomizations which are not referenced by other kustomizations (eg. as resource), optionally limited by the pattern.
+			The applications use the subst plugin, their names are derived from the directories. The secret with the decryption keys is derived
+			from the application name the same way 'subst render' does, it's added to the info of the applications`),
+		Example: `# Generate an application per overlay
+subst generate apps --repo-url https://github.com/example/gitops.git
+# Generate an application per cluster overlay
+subst generate apps --pattern 'clusters/*' --repo-url https://github.com/example/gitops.git
+# Generate an ApplicationSet
+subst generate apps --pattern 'clusters/*' --repo-url https://github.com/example/gitops.git --application-set clusters`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: generateApps,
+	}
+
+	flags := cmd.Flags()
+	flags.String("pattern", "", heredoc.Doc(`
+			Glob pattern the paths of the overlays (relative to the directory) must match, eg. 'clusters/*'`))
+	flags.String("repo-url", "", heredoc.Doc(`
+			Repository URL of the applications`))
+	flags.String("revision", "HEAD", heredoc.Doc(`
+			Target revision of the applications`))
+	flags.String("project", "default", heredoc.Doc(`
+			ArgoCD project of the applications`))
+	flags.String("namespace", "argocd", heredoc.Doc(`
+			Namespace of the applications`))
+	flags.String("dest-server", "https://kubernetes.default.svc", heredoc.Doc(`
+			Destination cluster of the applications`))
+	flags.String("dest-namespace", "", heredoc.Doc(`
+			Destination namespace of the applications, which is the namespace of the secret (defaults to the application name)`))
+	flags.String("plugin-name", "subst-v1.0", heredoc.Doc(`
+			Name of the config management plugin (<name>-<version> of the plugin configuration)`))
+	flags.String("prefix", "", heredoc.Doc(`
+			Prefix of the application names`))
+	flags.Bool("convert-secret-name", true, heredoc.Doc(`
+			Derive the secret names like 'subst render --convert-secret-name' (must match the plugin configuration)`))
+	flags.String("application-set", "", heredoc.Doc(`
+			Generate a single ApplicationSet with this name (list generator) instead of an Application per kustomization`))
+	_ = cmd.MarkFlagRequired("repo-url")
+	return cmd
+}
+
+func generateApps(cmd *cobra.Command, args []string) error {
+	dir, cleanup, err := rootDirectory(args)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	flags := cmd.Flags()
+	pattern, _ := flags.GetString("pattern")
+	appSet, _ := flags.GetString("application-set")
+	opts := argocd.AppOptions{}
+	opts.RepoURL, _ = flags.GetString("repo-url")
+	opts.Revision, _ = flags.GetString("revision")
+	opts.Project, _ = flags.GetString("project")
+	opts.Namespace, _ = flags.GetString("namespace")
+	opts.Server, _ = flags.GetString("dest-server")
+	opts.DestinationNamespace, _ = flags.GetString("dest-namespace")
+	opts.Plugin, _ = flags.GetString("plugin-name")
+	opts.Prefix, _ = flags.GetString("prefix")
+	opts.ConvertSecretName, _ = flags.GetBool("convert-secret-name")
+
+	dirs, err := discoverOverlays(dir, pattern)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("no overlays found within %s", dir)
+	}
+
+	// Paths of the applications are relative to the repository
+	base := dir
+	if repo, err := git.Open(dir); err == nil {
+		base = repo.WorkTree()
+	} else if !errors.Is(err, git.ErrNotRepository) {
+		return err
+	}
+	overlays, err := argocd.Overlays(base, dirs, opts)
+	if err != nil {
+		return err
+	}
+
+	var docs []interface{}
+	if appSet != "" {
+		docs = append(docs, argocd.NewApplicationSet(appSet, overlays, opts))
+	} else {
+		for _, app := range argocd.Applications(overlays, opts) {
+			docs = append(docs, app)
+		}
+	}
+	for _, doc := range docs {
+		y, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(append([]byte("---\n"), y...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the overlays within the directory (sorted), the kustomizations which are not referenced by another kustomization.
+// References are discovered like for the render (without build). With pattern only the overlays matching it are returned
+func discoverOverlays(root string, pattern string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fSys := filesys.MakeFsOnDisk()
+
+	var kustomizations []string
+	referenced := make(map[string]bool)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !kustomize.IsKustomization(fSys, path) {
+			return nil
+		}
+		k, err := kustomize.Discover(path, kustomize.Options{FileSystem: fSys})
+		if err != nil {
+			return fmt.Errorf("failed to discover %s: %w", path, err)
+		}
+		kustomizations = append(kustomizations, path)
+		for _, p := range k.Paths {
+			if p != path {
+				referenced[p] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var overlays []string
+	for _, dir := range kustomizations {
+		if referenced[dir] {
+			continue
+		}
+		if pattern != "" {
+			rel, err := filepath.Rel(root, dir)
+			if err != nil {
+				return nil, err
+			}
+			match, err := filepath.Match(pattern, rel)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+			}
+			if !match {
+				continue
+			}
+		}
+		overlays = append(overlays, dir)
+	}
+	sort.Strings(overlays)
+	return overlays, nil
+}
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	decrypt "github.com/buttahtoast/pkg/decryptors"
+	"github.com/buttahtoast/subst/internal/kustomize"
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/buttahtoast/subst/pkg/subst"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// result of an overlay rendered by renderAll
+type overlayResult struct {
+	// Path of the overlay relative to the root directory
+	name string
+	dir  string
+	out  []byte
+	err  error
+}
+
+// renders every kustomization matching the pattern (relative to the root directory) one after another, kustomize
+// and spruce builds are serialized anyway. The output is written to a directory per overlay or to stdout,
+// failures are summarized at the end
+func renderAll(configuration config.Configuration, pattern string, outputDir string) error {
+	results, err := matchOverlays(configuration.RootDirectory, pattern)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("no kustomizations match %s", pattern)
+	}
+
+	ctx := context.Background()
+	// Decryptors (including the keys of the secret) and the parsed substitution files of common bases are shared by all overlays
+	decryptors, cleanup, err := subst.NewDecryptors(ctx, configuration)
+	if err != nil {
+		return fmt.Errorf("failed to initialize decryptors: %w", err)
+	}
+	defer cleanup()
+
+	cache, err := renderCache(configuration)
+	if err != nil {
+		return err
+	}
+
+	files := subst.NewFileCache()
+
+	for i := range results {
+		r := &results[i]
+		cfg := configuration
+		cfg.RootDirectory = r.dir
+		r.out, r.err = renderOverlay(ctx, cfg, decryptors, files, cache)
+		if r.err == nil && outputDir != "" {
+			r.err = writeOverlay(outputDir, r.name, configuration.Output, r.out)
+		}
+		logrus.Debugf("rendered %s", r.name)
+	}
+
+	if outputDir == "" {
+		if err := writeOverlayStream(os.Stdout, results, configuration.Output); err != nil {
+			return err
+		}
+	}
+
+	var failed []overlayResult
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d overlays failed:\n", len(failed), len(results))
+	for _, r := range failed {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", r.name, strings.TrimSpace(r.err.Error()))
+	}
+	return fmt.Errorf("%d of %d overlays failed", len(failed), len(results))
+}
+
+// returns the overlays with a kustomization matching the pattern (sorted). The overlays must be within the root directory,
+// their relative paths are used for the output directories
+func matchOverlays(root string, pattern string) ([]overlayResult, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(root, pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+	fSys := filesys.MakeFsOnDisk()
+	sort.Strings(matches)
+	var overlays []overlayResult
+	for _, match := range matches {
+		if !fSys.IsDir(match) || !kustomize.IsKustomization(fSys, match) {
+			continue
+		}
+		name, err := filepath.Rel(root, match)
+		if err != nil || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("kustomization %s is not within %s", match, root)
+		}
+		overlays = append(overlays, overlayResult{name: name, dir: match})
+	}
+	return overlays, nil
+}
+
+// renders the overlay with the shared decryptors and substitution files, the render cache is optional
+func renderOverlay(ctx context.Context, cfg config.Configuration, decryptors []decrypt.Decryptor, files *subst.FileCache, cache *subst.RenderCache) ([]byte, error) {
+	if cache != nil {
+		if out, ok := cache.Get(cfg, nil); ok {
+			return out, nil
+		}
+	}
+
+	b, err := subst.RenderBuild(ctx, cfg.RootDirectory,
+		subst.WithConfiguration(cfg),
+		subst.WithDecryptors(decryptors...),
+		subst.WithFileCache(files),
+	)
+	if err != nil {
+		return nil, err
+	}
+	out, err := utils.Marshal(b.Manifests, cfg.Output)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		if err := cache.Put(b, out); err != nil {
+			logrus.Warnf("failed to store render cache entry: %s", err)
+		}
+	}
+	return out, nil
+}
+
+// writes the output of the overlay to <output-dir>/<overlay>/manifests.<format>
+func writeOverlay(outputDir string, name string, output string, out []byte) error {
+	ext := "yaml"
+	if output == "json" {
+		ext = "json"
+	}
+	dir := filepath.Join(outputDir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "manifests."+ext), out, 0o644)
+}
+
+// writes the successful renders as one stream. YAML documents are annotated with a source comment,
+// JSON is written as one object (source and manifests) per overlay
+func writeOverlayStream(w io.Writer, results []overlayResult, output string) error {
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		if output == "json" {
+			if err := writeOverlayJSON(w, r); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(r.out) == 0 {
+			continue
+		}
+		// Separators of the documents are at the start of a line (content is indented)
+		docs := bytes.Split(bytes.TrimPrefix(r.out, []byte("---\n")), []byte("\n---\n"))
+		for i, doc := range docs {
+			if _, err := fmt.Fprintf(w, "---\n# Source: %s\n", r.name); err != nil {
+				return err
+			}
+			if _, err := w.Write(doc); err != nil {
+				return err
+			}
+			if i < len(docs)-1 {
+				if _, err := io.WriteString(w, "\n"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeOverlayJSON(w io.Writer, r overlayResult) error {
+	manifests := []json.RawMessage{}
+	dec := json.NewDecoder(bytes.NewReader(r.out))
+	for dec.More() {
+		var m json.RawMessage
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		manifests = append(manifests, m)
+	}
+	j, err := json.MarshalIndent(struct {
+		Source    string            `json:"source"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}{r.name, manifests}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(j))
+	return err
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/buttahtoast/subst/pkg/subst"
+	"github.com/spf13/cobra"
+)
+
+func newParametersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "parameters",
+		Short: "Announce substitutions as ArgoCD plugin parameters",
+		Long: heredoc.Doc(`
+			Run 'subst parameters' to announce the substitutions of the substitution files as parameters of the ArgoCD config management plugin
+			(parameters.dynamic). Values of the parameters (ARGOCD_APP_PARAMETERS) overwrite the substitutions when rendering.
+			Substitution files are not decrypted, encrypted values are announced without value. Cluster substitutions are not loaded`),
+		Example: `# Announce the parameters of the local kustomization
+subst parameters .`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: parameters,
+	}
+
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	return cmd
+}
+
+func parameters(cmd *cobra.Command, args []string) error {
+	dir, cleanup, err := rootDirectory(args)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
+	if err != nil {
+		return fmt.Errorf("failed loading configuration: %w", err)
+	}
+	// Decrypted values and cluster substitutions (eg. from secrets) must not be announced
+	configuration.SkipDecrypt = true
+	configuration.ClusterSelector = ""
+
+	m, err := subst.New(*configuration)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.BuildSubstitutions(); err != nil {
+		return err
+	}
+	params, err := m.Parameters()
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		params = []subst.Parameter{}
+	}
+	return json.NewEncoder(os.Stdout).Encode(params)
+}
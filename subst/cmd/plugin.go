@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/buttahtoast/subst/internal/argocd"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// Flags which are always passed to the plugin
+	pluginFlags = []string{"env-regex", "file-regex", "kubeconfig", "helm-command"}
+	// Flags of the command, which are not passed to the plugin
+	pluginSkipFlags = map[string]bool{"config": true, "format": true, "name": true, "plugin-version": true, "command": true, "image": true}
+	// Flags which must not be stored in the plugin configuration
+	pluginSecretFlags = []string{"ejson-key"}
+)
+
+func newPluginConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugin-config",
+		Short: "Generate the ArgoCD config management plugin configuration",
+		Long: heredoc.Doc(`
+			Run 'subst plugin-config' to generate the ConfigManagementPlugin configuration (or the values of the argo-cd chart for the sidecar)
+			of this version. The render flags are passed to the plugin: --env-regex, --file-regex, --kubeconfig (if set) and --helm-command are always passed,
+			other flags only if they are set`),
+		Example: `# Generate the plugin configuration
+subst plugin-config
+# Generate the argo-cd chart values with a custom file regex and without secret lookup
+subst plugin-config --format values --file-regex '.*subst\.yaml' --skip-secret-lookup`,
+		Args: cobra.NoArgs,
+		RunE: pluginConfig,
+	}
+
+	flags := cmd.Flags()
+	flags.String("format", "plugin", heredoc.Doc(`
+			Output format. One of: plugin (ConfigManagementPlugin), values (argo-cd chart values)`))
+	flags.String("name", "subst", heredoc.Doc(`
+			Name of the plugin`))
+	flags.String("plugin-version", "v1.0", heredoc.Doc(`
+			Version of the plugin (applications reference <name>-<version>)`))
+	flags.String("command", "/subst", heredoc.Doc(`
+			Path of the subst binary within the sidecar`))
+	flags.String("image", pluginImage(), heredoc.Doc(`
+			Image of the sidecar (values)`))
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	setFlagDefault(flags, "helm-command", "/helm")
+	return cmd
+}
+
+func pluginConfig(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	for _, name := range pluginSecretFlags {
+		if flags.Changed(name) {
+			return fmt.Errorf("--%s must not be stored in the plugin configuration, use the secret instead", name)
+		}
+	}
+
+	opts := argocd.PluginOptions{}
+	opts.Name, _ = flags.GetString("name")
+	opts.Version, _ = flags.GetString("plugin-version")
+	opts.Command, _ = flags.GetString("command")
+	opts.Image, _ = flags.GetString("image")
+	opts.Args = pluginArgs(flags)
+
+	var doc interface{}
+	switch format, _ := flags.GetString("format"); format {
+	case "plugin":
+		doc = argocd.NewPlugin(opts)
+	case "values":
+		doc = argocd.NewValues(opts)
+	default:
+		return fmt.Errorf("invalid format %q", format)
+	}
+
+	y, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(y)
+	return err
+}
+
+// returns the flags passed to the plugin (sorted by name)
+func pluginArgs(flags *flag.FlagSet) []string {
+	always := make(map[string]bool, len(pluginFlags))
+	for _, name := range pluginFlags {
+		always[name] = true
+	}
+
+	var args []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if pluginSkipFlags[f.Name] || !(f.Changed || always[f.Name]) {
+			return
+		}
+		switch v := f.Value.(type) {
+		case flag.SliceValue:
+			for _, item := range v.GetSlice() {
+				args = append(args, "--"+f.Name, item)
+			}
+		default:
+			if f.Value.Type() == "bool" {
+				args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+			} else if s := f.Value.String(); s != "" {
+				args = append(args, "--"+f.Name, s)
+			}
+		}
+	})
+	return args
+}
+
+// sets the default of the flag, without marking it as changed
+func setFlagDefault(flags *flag.FlagSet, name string, value string) {
+	f := flags.Lookup(name)
+	if f == nil {
+		return
+	}
+	_ = f.Value.Set(value)
+	f.DefValue = value
+}
+
+// returns the image of the sidecar matching this version
+func pluginImage() string {
+	tag := Version
+	if tag == "unreleased" {
+		tag = "latest"
+	}
+	return "ghcr.io/buttahtoast/subst-cmp:" + tag
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/MakeNowJust/heredoc"
@@ -13,6 +14,11 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
+const (
+	// Environment variable with the key to encrypt the cached renders
+	renderCacheKeyVariable = "SUBST_RENDER_CACHE_KEY"
+)
+
 func newRenderCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "render",
@@ -22,13 +28,27 @@ func newRenderCmd() *cobra.Command {
 		Example: `# Render the local manifests
 subst render 
 # Render in a different directory
-subst render ../examples/02-overlays/clusters/cluster-01`,
+subst render ../examples/02-overlays/clusters/cluster-01
+# Re-render on changes and print the differences
+subst render --watch
+# Render all cluster overlays
+subst render --all 'clusters/*' --output-dir rendered`,
 		RunE: render,
 	}
 
 	flags := cmd.Flags()
 	addCommonFlags(flags)
 	addRenderFlags(flags)
+	flags.Bool("render-cache", false, heredoc.Doc(`
+			Return the cached output if the configuration, environment and inputs of the kustomization did not change.
+			Renders with decrypted material are only cached with a key (SUBST_RENDER_CACHE_KEY environment variable)`))
+	flags.String("all", "", heredoc.Doc(`
+			Render every kustomization matching the glob pattern (relative to the directory), eg. 'clusters/*'`))
+	flags.String("output-dir", "", heredoc.Doc(`
+			Write the render of each kustomization to <output-dir>/<path>/manifests.<output> (with --all).
+			Otherwise the renders are written to stdout, annotated with the source kustomization`))
+	flags.Bool("watch", false, heredoc.Doc(`
+			Watch the paths and inputs of the kustomization, re-render on changes and print the differences to the previous render`))
 	return cmd
 }
 
@@ -39,10 +59,19 @@ func addRenderFlags(flags *flag.FlagSet) {
 	if flags.Lookup("kube-api") == nil {
 		flags.String("kube-api", "", "Kubernetes API Url")
 	}
+	flags.String("kube-token-file", "", heredoc.Doc(`
+			Path to a bearer token for requests to the kubernetes API (used without kubeconfig, defaults to the service account token)`))
+	flags.String("kube-ca-file", "", heredoc.Doc(`
+			Path to the CA certificate of the kubernetes API (used without kubeconfig, defaults to the service account CA)`))
+	flags.Duration("kubectl-timeout", 30*time.Second, heredoc.Doc(`
+			Timeout for requests to the kubernetes API (0 disables the timeout)`))
 	flags.Bool("convert-secret-name", true, heredoc.Doc(`
 			Assuming the secret name is derived from ARGOCD_APP_NAME, this option will only use the application name (without project-name_)`))
 	flags.Bool("skip-secret-lookup", false, heredoc.Doc(`
 		Skip reading from decryption keys from Secret`))
+	flags.Bool("secret-required", false, heredoc.Doc(`
+			Fail if the decryption keys can't be loaded from the Secret (eg. missing or forbidden, no secret name or --skip-secret-lookup), otherwise the render continues without them.
+			Transient errors are retried within the kubectl timeout`))
 	flags.String("secret-name", "", heredoc.Doc(`
 	        Specify Secret name (each key within the secret will be used as a decryption key)`))
 	flags.String("secret-namespace", "", heredoc.Doc(`
@@ -58,49 +87,143 @@ func addRenderFlags(flags *flag.FlagSet) {
 			Skip decryption`))
 	flags.String("env-regex", "^ARGOCD_ENV_.*$", heredoc.Doc(`
 	        Only expose environment variables that match the given regex`))
+	flags.Bool("env-parse", false, heredoc.Doc(`
+			Parse environment variables into nested substitutions (CLUSTER__DNS__ZONE becomes CLUSTER.DNS.ZONE)
+			and convert JSON/YAML, boolean and number values to their types`))
+	flags.Bool("env-lowercase", false, heredoc.Doc(`
+			Convert the keys of environment variables to lowercase`))
+	flags.Bool("skip-git", false, heredoc.Doc(`
+			Skip reading git metadata substitutions`))
+	flags.Bool("git-status", false, heredoc.Doc(`
+			Compare the work tree with the current commit for the git.dirty and git.changedFiles substitutions`))
+	flags.String("cluster-selector", "", heredoc.Doc(`
+			Load substitutions from ConfigMaps matching the given label selector (eg. 'subst/substitutions=true')`))
+	flags.String("cluster-namespace", "", heredoc.Doc(`
+			Namespace to load substitutions from (defaults to the secret namespace)`))
+	flags.Bool("cluster-secrets", false, heredoc.Doc(`
+			Also load substitutions from Secrets matching the cluster selector`))
+	flags.String("cluster-precedence", "low", heredoc.Doc(`
+			Precedence of substitutions from the cluster. One of: low (substitution files overwrite cluster values), high`))
+	flags.String("load-restrictor", "LoadRestrictionsNone", heredoc.Doc(`
+			Restrictions for loading files in kustomize builds. One of: LoadRestrictionsNone, LoadRestrictionsRootOnly`))
+	flags.Bool("enable-alpha-plugins", true, heredoc.Doc(`
+			Enable kustomize plugins and KRM functions`))
+	flags.Bool("enable-exec", false, heredoc.Doc(`
+			Enable exec KRM functions (requires --enable-alpha-plugins)`))
+	flags.Bool("enable-helm", true, heredoc.Doc(`
+			Enable inflation of helm charts (helmCharts)`))
+	flags.String("helm-command", "helm", heredoc.Doc(`
+			Helm binary used for chart inflation`))
+	flags.String("helm-chart-home", "", heredoc.Doc(`
+			Directory to pull helm charts to (used for kustomizations without helmGlobals.chartHome)`))
+	flags.Bool("enable-managedby-label", false, heredoc.Doc(`
+			Add the app.kubernetes.io/managed-by label to all resources`))
+	flags.String("reorder", "none", heredoc.Doc(`
+			Order of the resources. One of: none (order as declared), legacy (kustomize legacy order)`))
+	flags.Bool("eval-kustomization", false, heredoc.Doc(`
+			Evaluate spruce operators and go templates in kustomization files with the substitutions before the build`))
+	flags.Bool("remote-resources", false, heredoc.Doc(`
+			Fetch remote kustomize resources (git) to discover substitution files within them, otherwise they are skipped`))
+	flags.String("cache-dir", "", heredoc.Doc(`
+			Directory to cache remote sources and resources (defaults to the user cache directory)`))
+	flags.Bool("offline", false, heredoc.Doc(`
+			Only use cached remote sources and resources, fails if they are not cached`))
 	flags.String("output", "yaml", heredoc.Doc(`
 	        Output format. One of: yaml, json`))
 
 }
 
 func render(cmd *cobra.Command, args []string) error {
-	dir, err := rootDirectory(args)
+	dir, cleanup, err := rootDirectory(args)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
 
 	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
 	if err != nil {
 		return fmt.Errorf("failed loading configuration: %w", err)
 	}
-	m, err := subst.New(*configuration)
+
+	flags := cmd.Flags()
+	watch, _ := flags.GetBool("watch")
+	if all, _ := flags.GetString("all"); all != "" {
+		if watch {
+			return fmt.Errorf("--watch can't be used with --all")
+		}
+		outputDir, _ := flags.GetString("output-dir")
+		return renderAll(*configuration, all, outputDir)
+	}
+	if watch {
+		return watchRender(*configuration)
+	}
+
+	cache, err := renderCache(*configuration)
 	if err != nil {
 		return err
 	}
+	if cache != nil {
+		if out, ok := cache.Get(*configuration, nil); ok {
+			_, err = os.Stdout.Write(out)
+			return err
+		}
+	}
 
-	err = m.BuildSubstitutions()
+	m, err := renderBuild(*configuration)
 	if err != nil {
 		return err
 	}
+	out, err := utils.Marshal(m.Manifests, configuration.Output)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		if err := cache.Put(m, out); err != nil {
+			logrus.Warnf("failed to store render cache entry: %s", err)
+		}
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// returns the render cache if enabled
+func renderCache(configuration config.Configuration) (*subst.RenderCache, error) {
+	if !configuration.RenderCache {
+		return nil, nil
+	}
+	// The key is only read from the environment, so it's not part of the configuration (printed and logged)
+	key := os.Getenv(renderCacheKeyVariable)
+	cacheDir := configuration.CacheDir
+	if cacheDir == "" {
+		cacheDir = subst.DefaultCacheDir()
+	}
+	cache, err := subst.NewRenderCache(cacheDir, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize render cache: %w", err)
+	}
+	return cache, nil
+}
+
+// builds the substitutions and manifests of the configuration
+func renderBuild(configuration config.Configuration) (*subst.Build, error) {
+	m, err := subst.New(configuration)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	err = m.BuildSubstitutions()
+	if err != nil {
+		return m, err
+	}
 
 	start := time.Now() // Start time measurement
-	if m != nil {
-		err = m.Build()
-		if err != nil {
-			return err
-		}
-		if m.Manifests != nil {
-			for _, f := range m.Manifests {
-				if configuration.Output == "json" {
-					utils.PrintJSON(f)
-				} else {
-					utils.PrintYAML(f)
-				}
-			}
-		}
+	err = m.Build()
+	if err != nil {
+		return m, err
 	}
 	elapsed := time.Since(start) // Calculate elapsed time
 	logrus.Debug("Build time: ", elapsed)
 
-	return nil
+	return m, nil
 }
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 
+	"github.com/buttahtoast/subst/internal/kustomize"
+	"github.com/buttahtoast/subst/pkg/subst"
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 
@@ -14,8 +17,9 @@ import (
 )
 
 var (
-	cfgFile string
-	v       string
+	cfgFile     string
+	v           string
+	errorFormat string
 )
 
 func NewRootCmd() *cobra.Command {
@@ -28,22 +32,35 @@ func NewRootCmd() *cobra.Command {
 	}
 
 	//Here is where we define the PreRun func, using the verbose flag value
-	//We use the standard output for logs.
+	//We use the standard error for logs, the standard output is reserved for the manifests.
 	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		if err := setUpLogs(os.Stdout, v); err != nil {
+		if err := setUpLogs(os.Stderr, v); err != nil {
 			return err
 		}
+		switch errorFormat {
+		case "text":
+		case "json":
+			// Errors are printed by Execute
+			cmd.SilenceErrors = true
+		default:
+			return fmt.Errorf("invalid error format %q", errorFormat)
+		}
 		return nil
 	}
 
 	//Default value is the warn level
 	cmd.PersistentFlags().StringVarP(&v, "verbosity", "v", logrus.WarnLevel.String(), "Log level (debug, info, warn, error, fatal, panic")
+	cmd.PersistentFlags().StringVar(&errorFormat, "error-format", "text", "Error output format (text, json). JSON errors are printed to stderr")
 
 	cmd.AddCommand(newDiscoverCmd())
 	cmd.AddCommand(newVersionCmd())
 	cmd.AddCommand(newGenerateDocsCmd())
 	cmd.AddCommand(newRenderCmd())
 	cmd.AddCommand(newSubstitutionsCmd())
+	cmd.AddCommand(newServeCmd())
+	cmd.AddCommand(newGenerateCmd())
+	cmd.AddCommand(newParametersCmd())
+	cmd.AddCommand(newPluginConfigCmd())
 	//
 
 	cmd.DisableAutoGenTag = true
@@ -54,7 +71,13 @@ func NewRootCmd() *cobra.Command {
 // Execute runs the application
 func Execute() {
 	if err := NewRootCmd().Execute(); err != nil {
-		fmt.Println(err)
+		if errorFormat == "json" {
+			if err := json.NewEncoder(os.Stderr).Encode(subst.Details(err)); err != nil {
+				fmt.Println(err)
+			}
+		} else {
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
 }
@@ -74,22 +97,38 @@ func addCommonFlags(flags *flag.FlagSet) {
 	flags.StringVar(&cfgFile, "config", "", "Config file")
 	flags.String("file-regex", "(.*subst\\.yaml|.*(ejson))", heredoc.Doc(`
 			Regex Pattern to discover substitution files`))
+	flags.Bool("recursive", false, heredoc.Doc(`
+			Discover substitution files in subdirectories of the kustomize paths`))
+	flags.Int("recursive-depth", 0, heredoc.Doc(`
+			Maximum depth of subdirectories to discover substitution files in (0 is unlimited)`))
 	flags.Bool("debug", false, heredoc.Doc(`
 			Print CLI calls of external tools to stdout (caution: setting this may
 			expose sensitive data)`))
 }
 
-func rootDirectory(args []string) (directory string, err error) {
+// Returns the absolute root directory. Git repositories are checked out into a temporary
+// workspace, which is removed by the returned cleanup function
+func rootDirectory(args []string) (directory string, cleanup func(), err error) {
+	cleanup = func() {}
 	directory = "."
 	if len(args) > 0 {
 		directory = args[0]
 	}
+
+	if kustomize.IsRepository(directory) {
+		directory, cleanup, err = kustomize.Workspace(directory)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
 	rootAbs, err := filepath.Abs(directory)
 	if err != nil {
-		return "", fmt.Errorf("failed resolving root directory: %w", err)
+		cleanup()
+		return "", nil, fmt.Errorf("failed resolving root directory: %w", err)
 	} else {
 		directory = rootAbs
 	}
 
-	return directory, nil
+	return directory, cleanup, nil
 }
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/MakeNowJust/heredoc"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/buttahtoast/subst/pkg/subst"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve a render API over HTTP",
+		Long: heredoc.Doc(`
+			Run 'subst serve' to render kustomizations over HTTP (or a unix socket). Decryptors and the kubernetes client are
+			kept between requests, which avoids the startup costs of each render. The flags are the base configuration for all requests.
+			Without --secret-name the secret with the decryption keys is derived from ARGOCD_APP_NAME and ARGOCD_APP_NAMESPACE of the
+			request environment (the API is not authenticated, every client can use all secrets the server can read)`),
+		Example: `# Listen on the default unix socket
+subst serve --base-dir /repos
+# Render a directory
+curl --unix-socket /tmp/subst.sock -d '{"directory": "repo/clusters/prod"}' http://subst/render`,
+		Args: cobra.NoArgs,
+		RunE: serve,
+	}
+
+	flags := cmd.Flags()
+	addCommonFlags(flags)
+	addRenderFlags(flags)
+	flags.String("listen", "unix://"+filepath.Join(os.TempDir(), "subst.sock"), heredoc.Doc(`
+			Address to listen on. Use unix://<path> for a unix socket (only accessible by the user) or <host>:<port> for TCP
+			(accessible by every process which can reach it)`))
+	flags.String("base-dir", "", heredoc.Doc(`
+			Resolve relative directories of requests within this directory and reject directories outside of it`))
+	_ = cmd.MarkFlagRequired("base-dir")
+	flags.Int("max-concurrent", runtime.NumCPU(), heredoc.Doc(`
+			Maximum number of concurrent renders`))
+	flags.Duration("request-timeout", 2*time.Minute, heredoc.Doc(`
+			Timeout of a render request`))
+	flags.Duration("decryptor-ttl", 5*time.Minute, heredoc.Doc(`
+			Lifetime of initialized decryptors, afterwards the keys are loaded again from the secret (0 keeps them)`))
+	return cmd
+}
+
+func serve(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	opts := subst.ServerOptions{}
+	opts.BaseDir, _ = flags.GetString("base-dir")
+
+	// The directory of each request replaces the root directory
+	configuration, err := config.LoadConfiguration(cfgFile, cmd, opts.BaseDir)
+	if err != nil {
+		return fmt.Errorf("failed loading configuration: %w", err)
+	}
+
+	listen, _ := flags.GetString("listen")
+	opts.MaxConcurrent, _ = flags.GetInt("max-concurrent")
+	opts.Timeout, _ = flags.GetDuration("request-timeout")
+	opts.DecryptorTTL, _ = flags.GetDuration("decryptor-ttl")
+
+	server, err := subst.NewServer(*configuration, opts)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	listener, err := listener(listen)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			logrus.Warnf("failed to shut down server: %s", err)
+		}
+	}()
+
+	logrus.Infof("listening on %s", listen)
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// returns the listener for the address (tcp or unix://<path>). Unix sockets are only accessible by the user
+func listener(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix://"); path != address {
+		// Remove stale socket of a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// The socket is created with 0600 (no window with broader permissions)
+		umask := syscall.Umask(0o177)
+		l, err := net.Listen("unix", path)
+		syscall.Umask(umask)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0o600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	logrus.Warnf("listening on %s without authentication, every process which can reach it can render with the decryption keys", address)
+	return net.Listen("tcp", address)
+}
@@ -27,10 +27,11 @@ func newSubstitutionsCmd() *cobra.Command {
 }
 
 func substitutions(cmd *cobra.Command, args []string) error {
-	dir, err := rootDirectory(args)
+	dir, cleanup, err := rootDirectory(args)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
 
 	configuration, err := config.LoadConfiguration(cfgFile, cmd, dir)
 	if err != nil {
@@ -41,6 +42,11 @@ func substitutions(cmd *cobra.Command, args []string) error {
 		return err
 	}
 	if m != nil {
+		defer m.Close()
+		err = m.BuildSubstitutions()
+		if err != nil {
+			return err
+		}
 		if len(m.Substitutions.Subst) > 0 {
 			if configuration.Output == "json" {
 				utils.PrintJSON(m.Substitutions.Subst)
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/buttahtoast/subst/internal/utils"
+	"github.com/buttahtoast/subst/pkg/config"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Changes within this period are combined into one render (editors write files in several steps)
+	watchDebounce = 300 * time.Millisecond
+)
+
+// renders the configuration on each change of the watched directories and prints the differences
+func watchRender(configuration config.Configuration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	watched := make(map[string]bool)
+	var previous []byte
+	first := true
+
+	for {
+		current, dirs, err := renderOutput(configuration)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "render failed: %s\n", err)
+		case first:
+			os.Stdout.Write(current)
+		default:
+			printDiff(previous, current)
+		}
+		if err == nil {
+			previous, first = current, false
+		}
+		if dirs == nil && len(watched) == 0 {
+			// Kustomization could not be resolved, watch the root directory until it can
+			dirs = []string{configuration.RootDirectory}
+		}
+		if dirs != nil {
+			syncWatches(watcher, watched, dirs)
+		}
+		fmt.Fprintf(os.Stderr, "watching %d directories for changes\n", len(watched))
+
+		if !waitForChange(ctx, watcher) {
+			return nil
+		}
+	}
+}
+
+// returns the rendered output and the directories of the kustomization (nil if it could not be resolved)
+func renderOutput(configuration config.Configuration) ([]byte, []string, error) {
+	m, err := renderBuild(configuration)
+	var dirs []string
+	if m != nil && m.Kustomization != nil {
+		dirs = m.Kustomization.Dirs()
+	}
+	if err != nil {
+		return nil, dirs, err
+	}
+	out, err := utils.Marshal(m.Manifests, configuration.Output)
+	return out, dirs, err
+}
+
+// watches the directories and removes watches of directories which are no longer used
+func syncWatches(watcher *fsnotify.Watcher, watched map[string]bool, dirs []string) {
+	wanted := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		wanted[abs] = true
+		if watched[abs] {
+			continue
+		}
+		if err := watcher.Add(abs); err != nil {
+			logrus.Warnf("failed to watch %s: %s", abs, err)
+			continue
+		}
+		watched[abs] = true
+	}
+	for dir := range watched {
+		if !wanted[dir] {
+			_ = watcher.Remove(dir)
+			delete(watched, dir)
+		}
+	}
+}
+
+// blocks until a change was observed (true) or the context is done (false)
+func waitForChange(ctx context.Context, watcher *fsnotify.Watcher) bool {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return false
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			logrus.Debugf("observed change: %s", event)
+			debounce = time.After(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return false
+			}
+			logrus.Warnf("watch error: %s", err)
+		case <-debounce:
+			return true
+		}
+	}
+}
+
+// prints the unified diff between the previous and the current render
+func printDiff(previous []byte, current []byte) {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(previous)),
+		B:        difflib.SplitLines(string(current)),
+		FromFile: "previous",
+		ToFile:   "current",
+		Context:  3,
+	})
+	if err != nil {
+		logrus.Warnf("failed to diff renders: %s", err)
+		return
+	}
+	if diff == "" {
+		fmt.Fprintln(os.Stderr, "no changes")
+		return
+	}
+	fmt.Fprint(os.Stdout, diff)
+}